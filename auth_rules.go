@@ -0,0 +1,121 @@
+package pggateway
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type authRule struct {
+	name     string
+	plugin   AuthenticationPlugin
+	reject   bool
+	user     *regexp.Regexp
+	database *regexp.Regexp
+	network  *net.IPNet
+	ssl      *bool
+
+	// Database name may also match the user name, `sameuser` in pg_hba.conf
+	sameUser bool
+}
+
+func newAuthRule(config AuthenticationRuleConfig, plugins map[string]AuthenticationPlugin) (*authRule, error) {
+	rule := &authRule{
+		name:   config.Plugin,
+		reject: config.Reject,
+		ssl:    config.SSL,
+	}
+
+	if !rule.reject {
+		var ok bool
+		rule.plugin, ok = plugins[config.Plugin]
+		if !ok {
+			return nil, fmt.Errorf("authentication rule references unknown plugin %#v", config.Plugin)
+		}
+	}
+
+	var err error
+	if config.User != "" {
+		rule.user, err = GlobToRegexp(config.User)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication rule user %#v: %s", config.User, err)
+		}
+	}
+
+	if config.Database != "" {
+		rule.database, err = GlobToRegexp(config.Database)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication rule database %#v: %s", config.Database, err)
+		}
+	}
+
+	if config.Address != "" {
+		rule.network, err = parseNetwork(config.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authentication rule address %#v: %s", config.Address, err)
+		}
+	}
+
+	return rule, nil
+}
+
+func (r *authRule) matches(user []byte, database []byte, addr net.Addr, isSSL bool) bool {
+	if r.user != nil && !r.user.Match(user) {
+		return false
+	}
+	if r.sameUser || r.database != nil {
+		sameUser := r.sameUser && string(database) == string(user)
+		if !sameUser && (r.database == nil || !r.database.Match(database)) {
+			return false
+		}
+	}
+	if r.ssl != nil && *r.ssl != isSSL {
+		return false
+	}
+	if r.network != nil {
+		ip := remoteIP(addr)
+		if ip == nil || !r.network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetwork parses a CIDR block, or a single IP address as a host network
+func parseNetwork(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		return network, err
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address")
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func hostString(addr net.Addr) string {
+	if ip := remoteIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,536 @@
+package pggateway
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+// Connection pooling modes
+const (
+	poolModeTransaction = "transaction"
+	poolModeSession     = "session"
+)
+
+// How often idle backends are checked for expiry and pools topped up to their minimum size
+const backendMaintenanceInterval = 10 * time.Second
+
+// Resets the session state a transaction left on a backend in `transaction` mode, like DISCARD ALL but keeping
+// the prepared statements shared by all sessions using the backend
+const transactionResetQuery = "SET SESSION AUTHORIZATION DEFAULT; RESET ROLE; RESET ALL; CLOSE ALL; UNLISTEN *; " +
+	"SELECT pg_advisory_unlock_all(); DISCARD TEMP; DISCARD SEQUENCES"
+
+var errPoolWaitTimeout = fmt.Errorf("timed out waiting for a target server connection")
+
+// backend is a target server connection logged in by the gateway, which can be shared between sessions
+type backend struct {
+	conn     net.Conn
+	member   *targetMember
+	created  time.Time
+	lastUsed time.Time
+	// The target server's key for cancelling queries on the connection
+	key backendKey
+
+	// Gateway names of the statements prepared on the connection, see pooledStatementName
+	prepared map[string]bool
+}
+
+// backendPools holds the pools of backends for a database, one for each target user, set of startup options and `target_session_attrs`
+type backendPools struct {
+	mode        string
+	size        int
+	minSize     int
+	waitTimeout time.Duration
+	resetQuery  string
+
+	// Zero for no limit
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+
+	targets *targetPool
+	plugins *PluginRegistry
+
+	pools map[string]*backendPool
+	stop  chan struct{}
+	mutex *sync.Mutex
+}
+
+func newBackendPools(config PoolConfig, targets *targetPool, plugins *PluginRegistry) (*backendPools, error) {
+	p := &backendPools{
+		mode:       config.Mode,
+		size:       config.Size,
+		minSize:    config.MinSize,
+		resetQuery: config.ResetQuery,
+		targets:    targets,
+		plugins:    plugins,
+		pools:      make(map[string]*backendPool),
+		mutex:      &sync.Mutex{},
+	}
+	switch p.mode {
+	case "":
+		return nil, fmt.Errorf("'pool.mode' configuration value is required")
+	case poolModeTransaction, poolModeSession:
+	default:
+		return nil, fmt.Errorf("unknown pool mode %#v", config.Mode)
+	}
+	if p.size <= 0 {
+		p.size = 20
+	}
+	if p.minSize > p.size {
+		return nil, fmt.Errorf("pool min_size %d is larger than size %d", p.minSize, p.size)
+	}
+	if p.resetQuery == "" {
+		p.resetQuery = "DISCARD ALL"
+	}
+
+	var err error
+	p.waitTimeout, err = parseDurationDefault(config.WaitTimeout, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool wait_timeout %#v: %s", config.WaitTimeout, err)
+	}
+	p.idleTimeout, err = parseDurationDefault(config.IdleTimeout, 10*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool idle_timeout %#v: %s", config.IdleTimeout, err)
+	}
+	p.maxLifetime, err = parseDurationDefault(config.MaxLifetime, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pool max_lifetime %#v: %s", config.MaxLifetime, err)
+	}
+	return p, nil
+}
+
+// start runs the background maintenance of the pools
+func (p *backendPools) start() {
+	p.stop = make(chan struct{})
+	go p.maintain(p.stop)
+}
+
+func (p *backendPools) close() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (p *backendPools) maintain(stop chan struct{}) {
+	ticker := time.NewTicker(backendMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		p.maintainPools()
+	}
+}
+
+func (p *backendPools) maintainPools() {
+	p.mutex.Lock()
+	pools := make([]*backendPool, 0, len(p.pools))
+	for _, pool := range p.pools {
+		pools = append(pools, pool)
+	}
+	p.mutex.Unlock()
+
+	for _, pool := range pools {
+		pool.maintain()
+	}
+
+	// Pools nothing uses any more are dropped, along with the password they were last given
+	p.mutex.Lock()
+	for key, pool := range p.pools {
+		if pool.unused() {
+			delete(p.pools, key)
+		}
+	}
+	p.mutex.Unlock()
+}
+
+func (p *backendPools) expired(b *backend, now time.Time) bool {
+	return p.maxLifetime > 0 && now.Sub(b.created) > p.maxLifetime
+}
+
+// get returns the pool for the target user, startup options and session attributes for a session to use, updating the password
+// new connections log in with. The session must give the pool back with put once it ends.
+func (p *backendPools) get(user []byte, password []byte, options map[string][]byte, attrs string) *backendPool {
+	key := backendPoolKey(user, options, attrs)
+
+	p.mutex.Lock()
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = &backendPool{
+			pools:   p,
+			user:    user,
+			options: options,
+			attrs:   attrs,
+			idle:    make([]*backend, 0),
+			mutex:   &sync.Mutex{},
+		}
+		p.pools[key] = pool
+	}
+
+	// Counted while the pools are locked, so the pool is not dropped before the session uses it
+	pool.mutex.Lock()
+	pool.password = password
+	pool.sessions++
+	pool.lastUsed = time.Now()
+	pool.mutex.Unlock()
+	p.mutex.Unlock()
+	return pool
+}
+
+// backendPoolKey identifies a pool by its user, startup options, including the database, and session attributes
+func backendPoolKey(user []byte, options map[string][]byte, attrs string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{string(user), attrs}
+	for _, name := range names {
+		parts = append(parts, name, string(options[name]))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// discardUser drops the pools logged in as the user, closing their idle backends, and closes their backends
+// in use once they are returned, e.g. before the user's credentials are revoked
+func (p *backendPools) discardUser(user []byte) {
+	var pools []*backendPool
+	p.mutex.Lock()
+	for key, pool := range p.pools {
+		if bytes.Equal(pool.user, user) {
+			delete(p.pools, key)
+			pools = append(pools, pool)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, pool := range pools {
+		pool.mutex.Lock()
+		pool.discarded = true
+		idle := pool.idle
+		pool.idle = nil
+		pool.mutex.Unlock()
+
+		for _, b := range idle {
+			pool.discard(b)
+		}
+	}
+}
+
+// put gives back a pool a session got from get
+func (p *backendPools) put(pool *backendPool) {
+	pool.mutex.Lock()
+	pool.sessions--
+	pool.lastUsed = time.Now()
+	pool.mutex.Unlock()
+}
+
+// backendPool is a bounded pool of backends logged in to one target database as one user with the same startup options
+type backendPool struct {
+	pools *backendPools
+	user  []byte
+	// Startup options other than the user, including the database
+	options map[string][]byte
+	attrs   string
+
+	// Guarded by mutex
+	password []byte
+	idle     []*backend
+	// Backends in use, idle or being connected
+	open int
+	// Sessions using the pool, and when a session last started or stopped using it
+	sessions int
+	lastUsed time.Time
+	// Set once the pool is dropped by discardUser, backends returned to it are closed
+	discarded bool
+	// Sessions waiting for a backend, handed one or nil to connect a new one themselves
+	waiters []chan *backend
+	// ParameterStatus payloads from the last login, sent to clients in place of their own login's
+	parameters [][]byte
+	mutex      *sync.Mutex
+}
+
+// acquire returns an idle backend, connecting a new one while the pool is not full,
+// and otherwise waits for another session to release one
+func (p *backendPool) acquire() (*backend, error) {
+	p.mutex.Lock()
+	if n := len(p.idle); n > 0 {
+		b := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return b, nil
+	}
+	if p.open < p.pools.size {
+		p.open++
+		p.mutex.Unlock()
+		return p.connect()
+	}
+	wait := make(chan *backend, 1)
+	p.waiters = append(p.waiters, wait)
+	p.mutex.Unlock()
+
+	timer := time.NewTimer(p.pools.waitTimeout)
+	defer timer.Stop()
+	select {
+	case b := <-wait:
+		return p.handOff(b)
+	case <-timer.C:
+	}
+
+	p.mutex.Lock()
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mutex.Unlock()
+			return nil, errPoolWaitTimeout
+		}
+	}
+	p.mutex.Unlock()
+	// Handed a backend just as the wait timed out
+	return p.handOff(<-wait)
+}
+
+func (p *backendPool) handOff(b *backend) (*backend, error) {
+	if b == nil {
+		return p.connect()
+	}
+	return b, nil
+}
+
+// release returns a backend ready for another session to the pool
+func (p *backendPool) release(b *backend) {
+	b.lastUsed = time.Now()
+	if p.pools.expired(b, b.lastUsed) {
+		p.discard(b)
+		return
+	}
+
+	p.mutex.Lock()
+	if p.discarded {
+		p.mutex.Unlock()
+		p.discard(b)
+		return
+	}
+	defer p.mutex.Unlock()
+	if len(p.waiters) > 0 {
+		p.waiters[0] <- b
+		p.waiters = p.waiters[1:]
+		return
+	}
+	p.idle = append(p.idle, b)
+}
+
+// maintain closes idle backends which have been unused for too long or reached their maximum lifetime,
+// and connects new ones while the pool is below its minimum size. Only pools which have been used recently
+// are kept at their minimum size, the backends of others are closed once they are unused for too long.
+func (p *backendPool) maintain() {
+	now := time.Now()
+	p.mutex.Lock()
+	recent := p.sessions > 0 || p.pools.idleTimeout == 0 || now.Sub(p.lastUsed) <= p.pools.idleTimeout
+	var closing []*backend
+	idle := p.idle[:0]
+	// Idle backends are used last in first out, so the longest unused come first
+	for _, b := range p.idle {
+		unused := p.pools.idleTimeout > 0 && now.Sub(b.lastUsed) > p.pools.idleTimeout && (!recent || p.open-len(closing) > p.pools.minSize)
+		if unused || p.pools.expired(b, now) {
+			closing = append(closing, b)
+		} else {
+			idle = append(idle, b)
+		}
+	}
+	p.idle = idle
+	missing := 0
+	if recent {
+		missing = p.pools.minSize - (p.open - len(closing))
+	}
+	if missing > 0 {
+		p.open += missing
+	}
+	p.mutex.Unlock()
+
+	for _, b := range closing {
+		p.discard(b)
+	}
+	for i := 0; i < missing; i++ {
+		b, err := p.connect()
+		if err != nil {
+			p.pools.plugins.LogError(nil, "error opening pooled connection for user %#v: %s", string(p.user), err)
+			continue
+		}
+		p.release(b)
+	}
+}
+
+// unused returns whether no session uses the pool and it has no backends
+func (p *backendPool) unused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sessions == 0 && p.open == 0 && len(p.waiters) == 0
+}
+
+// discard closes a backend which cannot be reused
+func (p *backendPool) discard(b *backend) {
+	b.conn.Close()
+	p.pools.targets.release(b.member, nil)
+	p.releaseSlot()
+}
+
+// releaseSlot frees the place of a closed backend, letting the first waiting session connect a new one
+func (p *backendPool) releaseSlot() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.waiters) > 0 {
+		p.waiters[0] <- nil
+		p.waiters = p.waiters[1:]
+		return
+	}
+	p.open--
+}
+
+// connect opens and logs in a new backend, the pool must already count it as open
+func (p *backendPool) connect() (*backend, error) {
+	member, conn, err := p.pools.targets.dial(p.attrs)
+	if err != nil {
+		p.releaseSlot()
+		return nil, err
+	}
+	b := &backend{
+		conn:     conn,
+		member:   member,
+		created:  time.Now(),
+		lastUsed: time.Now(),
+		prepared: make(map[string]bool),
+	}
+
+	parameters, err := p.login(b)
+	if err != nil {
+		p.discard(b)
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.parameters = parameters
+	p.mutex.Unlock()
+	p.pools.plugins.LogDebug(nil, "opened pooled connection to target server %#v for user %#v", member.addr, string(p.user))
+	return b, nil
+}
+
+// login logs in to the target server and returns the ParameterStatus payloads it reports
+func (p *backendPool) login(b *backend) ([][]byte, error) {
+	p.mutex.Lock()
+	password := p.password
+	p.mutex.Unlock()
+
+	startup := &pgproto.StartupMessage{
+		Options: map[string][]byte{
+			"user": p.user,
+		},
+	}
+	for k, v := range p.options {
+		startup.Options[k] = v
+	}
+	err := serverLogin(b.conn, startup, p.user, password)
+	if _, ok := err.(*serverLoginError); ok && b.member.dialer.retrySSL(b.conn) {
+		// With `sslmode: allow` a rejected non-SSL login is retried over SSL
+		var conn net.Conn
+		conn, err = b.member.dialer.dialSSL(b.member.addr)
+		if err != nil {
+			return nil, err
+		}
+		b.conn.Close()
+		b.conn = conn
+		err = serverLogin(b.conn, startup, p.user, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parameters [][]byte
+	for {
+		typ, payload, err := readMessage(b.conn)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case messageTypeParameterStatus:
+			parameters = append(parameters, payload)
+		case messageTypeBackendKeyData:
+			b.key, _ = parseBackendKey(payload)
+		case messageTypeError:
+			return nil, &serverLoginError{payload: payload}
+		case messageTypeReadyForQuery:
+			return parameters, nil
+		}
+	}
+}
+
+// getParameters returns the ParameterStatus payloads reported to the pool's last login, logging in a backend if there was none
+func (p *backendPool) getParameters() ([][]byte, error) {
+	p.mutex.Lock()
+	parameters := p.parameters
+	p.mutex.Unlock()
+	if parameters != nil {
+		return parameters, nil
+	}
+
+	b, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	p.release(b)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.parameters, nil
+}
+
+// reset clears the session state left on a backend by a client, rolling back an open transaction first
+func (p *backendPool) reset(b *backend, status byte) error {
+	queries := []string{p.pools.resetQuery}
+	if status != 'I' {
+		queries = append([]string{"ROLLBACK"}, queries...)
+	}
+	if !strings.EqualFold(p.pools.resetQuery, "DISCARD ALL") {
+		queries = append(queries, "DEALLOCATE ALL")
+	}
+
+	err := p.exec(b, queries)
+	if err != nil {
+		return err
+	}
+	b.prepared = make(map[string]bool)
+	return nil
+}
+
+// resetTransaction clears the session state left on a backend by a client's transaction in `transaction` mode
+func (p *backendPool) resetTransaction(b *backend) error {
+	return p.exec(b, []string{transactionResetQuery})
+}
+
+// exec runs queries on an idle backend, discarding their results
+func (p *backendPool) exec(b *backend, queries []string) error {
+	b.conn.SetDeadline(time.Now().Add(p.pools.waitTimeout))
+	defer b.conn.SetDeadline(time.Time{})
+	for _, query := range queries {
+		err := writeMessage(b.conn, messageTypeQuery, append([]byte(query), 0))
+		if err != nil {
+			return err
+		}
+		_, err = waitForReady(b.conn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package pggateway
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type failureEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// bruteForceTracker counts failed authentications per user and per client address,
+// delaying and locking out further attempts once the configured thresholds are reached
+type bruteForceTracker struct {
+	delayAfter   int
+	delay        time.Duration
+	maxDelay     time.Duration
+	lockoutAfter int
+	lockout      time.Duration
+	window       time.Duration
+
+	entries   map[string]*failureEntry
+	lastSweep time.Time
+	mutex     *sync.Mutex
+
+	// Current time, replaced by tests
+	now func() time.Time
+}
+
+func newBruteForceTracker(config BruteForceConfig) (*bruteForceTracker, error) {
+	t := &bruteForceTracker{
+		delayAfter:   config.DelayAfter,
+		lockoutAfter: config.LockoutAfter,
+		entries:      make(map[string]*failureEntry),
+		lastSweep:    time.Now(),
+		mutex:        &sync.Mutex{},
+		now:          time.Now,
+	}
+	if t.delayAfter == 0 {
+		t.delayAfter = 3
+	}
+	if t.lockoutAfter == 0 {
+		t.lockoutAfter = 10
+	}
+
+	var err error
+	durations := []struct {
+		name  string
+		value string
+		d     time.Duration
+		dest  *time.Duration
+	}{
+		{"delay", config.Delay, time.Second, &t.delay},
+		{"max_delay", config.MaxDelay, 30 * time.Second, &t.maxDelay},
+		{"lockout", config.Lockout, 15 * time.Minute, &t.lockout},
+		{"window", config.Window, 15 * time.Minute, &t.window},
+	}
+	for _, d := range durations {
+		*d.dest = d.d
+		if d.value == "" {
+			continue
+		}
+		*d.dest, err = time.ParseDuration(d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid brute_force %s %#v: %s", d.name, d.value, err)
+		}
+	}
+
+	return t, nil
+}
+
+func bruteForceKeys(user []byte, addr net.Addr) []string {
+	return []string{"user:" + string(user), "address:" + hostString(addr)}
+}
+
+// lockedOut returns when the lockout of the user or client address ends, if either is locked out
+func (t *bruteForceTracker) lockedOut(user []byte, addr net.Addr) (time.Time, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	var until time.Time
+	for _, key := range bruteForceKeys(user, addr) {
+		e, ok := t.entries[key]
+		if ok && e.lockedUntil.After(now) && e.lockedUntil.After(until) {
+			until = e.lockedUntil
+		}
+	}
+	return until, !until.IsZero()
+}
+
+// failed records a failed authentication, returning how long to delay the response and whether it caused a lockout
+func (t *bruteForceTracker) failed(user []byte, addr net.Addr) (int, time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	failures := 0
+	locked := false
+	for _, key := range bruteForceKeys(user, addr) {
+		e, ok := t.entries[key]
+		if !ok {
+			e = &failureEntry{}
+			t.entries[key] = e
+		} else if now.Sub(e.lastFailure) > t.window {
+			e.failures = 0
+		}
+		e.failures++
+		e.lastFailure = now
+
+		if e.failures >= t.lockoutAfter && e.lockedUntil.Before(now) {
+			e.lockedUntil = now.Add(t.lockout)
+			locked = true
+		}
+		if e.failures > failures {
+			failures = e.failures
+		}
+	}
+
+	if failures < t.delayAfter {
+		return failures, 0, locked
+	}
+	delay := t.delay
+	for i := t.delayAfter; i < failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return failures, delay, locked
+}
+
+// succeeded forgets the failures of the user, failures from the client address are kept
+// so one valid account cannot be used to reset the address counter
+func (t *bruteForceTracker) succeeded(user []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := "user:" + string(user)
+	if e, ok := t.entries[key]; ok && e.lockedUntil.Before(t.now()) {
+		delete(t.entries, key)
+	}
+}
+
+// sweep removes expired entries, at most once per minute
+func (t *bruteForceTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+
+	for key, e := range t.entries {
+		if now.Sub(e.lastFailure) > t.window && e.lockedUntil.Before(now) {
+			delete(t.entries, key)
+		}
+	}
+}
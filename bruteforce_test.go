@@ -0,0 +1,136 @@
+package pggateway
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for the tracker which only moves when told to
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestBruteForceTracker(t *testing.T) (*bruteForceTracker, *testClock) {
+	tracker, err := newBruteForceTracker(BruteForceConfig{
+		DelayAfter:   2,
+		Delay:        "1s",
+		MaxDelay:     "5s",
+		LockoutAfter: 4,
+		Lockout:      "10m",
+		Window:       "5m",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Now()}
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+func testAddr(i int) net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 50000 + i}
+}
+
+func TestBruteForceDelay(t *testing.T) {
+	tracker, clock := newTestBruteForceTracker(t)
+
+	// Doubled for every failure from the second one, up to the maximum
+	for i, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		clock.Advance(time.Second)
+		failures, delay, locked := tracker.failed([]byte("alice"), testAddr(i))
+		if failures != i+1 || delay != expected {
+			t.Errorf("failure %d: expected a delay of %s, got %s after %d failures", i+1, expected, delay, failures)
+		}
+		// Reported once, when the lockout starts
+		if locked != (i+1 == 4) {
+			t.Errorf("failure %d: expected locked to be %v", i+1, i+1 == 4)
+		}
+	}
+}
+
+func TestBruteForceLockout(t *testing.T) {
+	tracker, clock := newTestBruteForceTracker(t)
+
+	// Per user, from any address
+	for i := 0; i < 4; i++ {
+		tracker.failed([]byte("alice"), testAddr(i))
+	}
+	until, locked := tracker.lockedOut([]byte("alice"), testAddr(100))
+	if !locked || !until.Equal(clock.now.Add(10*time.Minute)) {
+		t.Fatalf("expected alice to be locked out for 10m, got %v until %s", locked, until)
+	}
+	if _, locked := tracker.lockedOut([]byte("bob"), testAddr(100)); locked {
+		t.Fatal("expected bob not to be locked out")
+	}
+
+	// Per address, for any user
+	for _, user := range []string{"carol", "dave", "erin", "frank"} {
+		tracker.failed([]byte(user), testAddr(200))
+	}
+	if _, locked := tracker.lockedOut([]byte("grace"), testAddr(200)); !locked {
+		t.Fatal("expected the address to be locked out")
+	}
+	if _, locked := tracker.lockedOut([]byte("grace"), testAddr(201)); locked {
+		t.Fatal("expected other addresses not to be locked out")
+	}
+
+	// A success during the lockout does not end it
+	tracker.succeeded([]byte("alice"))
+	if _, locked := tracker.lockedOut([]byte("alice"), testAddr(100)); !locked {
+		t.Fatal("expected alice to stay locked out after a success")
+	}
+
+	clock.Advance(10*time.Minute + time.Second)
+	if _, locked := tracker.lockedOut([]byte("alice"), testAddr(100)); locked {
+		t.Fatal("expected the lockout of alice to end")
+	}
+	if _, locked := tracker.lockedOut([]byte("grace"), testAddr(200)); locked {
+		t.Fatal("expected the lockout of the address to end")
+	}
+}
+
+func TestBruteForceWindow(t *testing.T) {
+	tracker, clock := newTestBruteForceTracker(t)
+
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute)
+		tracker.failed([]byte("alice"), testAddr(1))
+	}
+
+	// Failures are forgotten once the window passed without another failure
+	clock.Advance(5*time.Minute + time.Second)
+	failures, delay, locked := tracker.failed([]byte("alice"), testAddr(1))
+	if failures != 1 || delay != 0 || locked {
+		t.Fatalf("expected the failures to be forgotten, got %d failures with a delay of %s", failures, delay)
+	}
+
+	// Successes forget the user's failures, but not the address's
+	tracker.failed([]byte("alice"), testAddr(1))
+	tracker.succeeded([]byte("alice"))
+	failures, _, _ = tracker.failed([]byte("alice"), testAddr(2))
+	if failures != 1 {
+		t.Fatalf("expected the user's failures to be forgotten, got %d failures", failures)
+	}
+	failures, _, _ = tracker.failed([]byte("bob"), testAddr(1))
+	if failures != 3 {
+		t.Fatalf("expected the address's failures to be kept, got %d failures", failures)
+	}
+
+	// Expired entries are swept on a later failure
+	clock.Advance(5*time.Minute + time.Second)
+	tracker.failed([]byte("carol"), testAddr(3))
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if len(tracker.entries) != 2 {
+		t.Fatalf("expected only the entries of the last failure to be kept, got %d entries", len(tracker.entries))
+	}
+}
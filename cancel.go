@@ -0,0 +1,149 @@
+package pggateway
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+)
+
+// Protocol code sent in place of a version by a CancelRequest
+const cancelRequestCode = 80877102
+
+// backendKey is the process ID and secret key identifying a session in a BackendKeyData message and CancelRequest
+type backendKey struct {
+	pid    uint32
+	secret uint32
+}
+
+func parseBackendKey(payload []byte) (backendKey, bool) {
+	if len(payload) != 8 {
+		return backendKey{}, false
+	}
+	return backendKey{
+		pid:    binary.BigEndian.Uint32(payload),
+		secret: binary.BigEndian.Uint32(payload[4:]),
+	}, true
+}
+
+func (k backendKey) payload() []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload, k.pid)
+	binary.BigEndian.PutUint32(payload[4:], k.secret)
+	return payload
+}
+
+// cancelKeys maps the backend keys issued to clients by the gateway to their sessions, shared by all listeners
+// so a CancelRequest reaches its session whichever listener it arrives on
+var cancelKeys = &cancelKeyRegistry{
+	sessions: make(map[backendKey]*Session),
+	mutex:    &sync.Mutex{},
+}
+
+type cancelKeyRegistry struct {
+	sessions map[backendKey]*Session
+	mutex    *sync.Mutex
+}
+
+// issue returns a new random key for the session
+func (r *cancelKeyRegistry) issue(s *Session) (backendKey, error) {
+	var buf [8]byte
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		_, err := rand.Read(buf[:])
+		if err != nil {
+			return backendKey{}, err
+		}
+		key, _ := parseBackendKey(buf[:])
+		// Clients may treat the process ID as signed
+		key.pid &= 0x7fffffff
+		if _, ok := r.sessions[key]; ok || key.pid == 0 {
+			continue
+		}
+		r.sessions[key] = s
+		return key, nil
+	}
+}
+
+func (r *cancelKeyRegistry) remove(key backendKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, key)
+}
+
+func (r *cancelKeyRegistry) session(key backendKey) (*Session, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, ok := r.sessions[key]
+	return s, ok
+}
+
+// handleCancel forwards a CancelRequest to the target server running the session it names, with the server's own key.
+// Like PostgreSQL nothing is sent back to the client, whether the key was known or not
+func (l *Listener) handleCancel(packet []byte) {
+	key, ok := parseBackendKey(packet[8:])
+	if !ok {
+		l.plugins.LogWarn(nil, "malformed cancel request")
+		return
+	}
+	sess, ok := cancelKeys.session(key)
+	if !ok {
+		l.plugins.LogWarn(nil, "cancel request for unknown backend key")
+		return
+	}
+
+	err := sess.cancel()
+	if err != nil {
+		sess.LogError("error forwarding cancel request: %s", err)
+		return
+	}
+	sess.LogInfo("forwarded cancel request")
+}
+
+// issueCancelKey issues the key given to the client in place of the target server's
+func (s *Session) issueCancelKey() (backendKey, error) {
+	key, err := cancelKeys.issue(s)
+	if err != nil {
+		return backendKey{}, err
+	}
+	s.cancelKey = &key
+	return key, nil
+}
+
+// cancel sends a CancelRequest for the query the session is running to its target server
+func (s *Session) cancel() error {
+	addr, dialer, key, ok := s.cancelTarget()
+	if !ok {
+		// A pooled session between transactions has nothing running
+		return nil
+	}
+
+	conn, err := dialer.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint32(packet, 16)
+	binary.BigEndian.PutUint32(packet[4:], cancelRequestCode)
+	copy(packet[8:], key.payload())
+	_, err = conn.Write(packet)
+	return err
+}
+
+// cancelTarget returns the target server and its key for the connection the session is using
+func (s *Session) cancelTarget() (string, *targetDialer, backendKey, bool) {
+	p := s.pooled
+	if p == nil {
+		return s.targetAddr, s.targetDialer, s.backendKey, true
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b := p.backend
+	if b == nil {
+		return "", nil, backendKey{}, false
+	}
+	return b.member.addr, b.member.dialer, b.key, true
+}
@@ -11,10 +11,16 @@ import (
 	"runtime/trace"
 
 	"github.com/c653labs/pggateway"
+	_ "github.com/c653labs/pggateway/plugins/cert-authentication"
 	_ "github.com/c653labs/pggateway/plugins/cloudwatchlogs-logging"
 	_ "github.com/c653labs/pggateway/plugins/file-logging"
 	_ "github.com/c653labs/pggateway/plugins/iam-authentication"
+	_ "github.com/c653labs/pggateway/plugins/jwt-authentication"
+	_ "github.com/c653labs/pggateway/plugins/ldap-authentication"
 	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+	_ "github.com/c653labs/pggateway/plugins/userlist-authentication"
+	_ "github.com/c653labs/pggateway/plugins/vault-authentication"
+	_ "github.com/c653labs/pggateway/plugins/webhook-authentication"
 )
 
 var (
@@ -1,6 +1,8 @@
 package pggateway
 
 import (
+	"time"
+
 	"github.com/go-yaml/yaml"
 )
 
@@ -8,12 +10,59 @@ type Config struct {
 	Procs     int                        `yaml:"procs,omitempty"`
 	Logging   map[string]ConfigMap       `yaml:"logging,omitempty"`
 	Listeners map[string]*ListenerConfig `yaml:"listeners,omitempty"`
+
+	// Failed authentication tracking shared by all listeners without their own `brute_force` configuration
+	BruteForce *BruteForceConfig `yaml:"brute_force,omitempty"`
 }
 
 type TargetConfig struct {
 	Host    string `yaml:"host,omitempty"`
 	Port    int    `yaml:"port,omitempty"`
 	SSLMode string `yaml:"sslmode,omitempty"`
+
+	// CA certificates to verify the server with, and a client certificate to present
+	SSLRootCert string `yaml:"sslrootcert,omitempty"`
+	SSLCert     string `yaml:"sslcert,omitempty"`
+	SSLKey      string `yaml:"sslkey,omitempty"`
+	// Server name sent with SNI and verified with `verify-full`, default the target host
+	SSLServerName string `yaml:"sslservername,omitempty"`
+
+	// Relative share of sessions with the `weighted` target strategy
+	Weight int `yaml:"weight,omitempty"`
+
+	// Time allowed to connect to the target server, including SSL negotiation
+	ConnectTimeout string `yaml:"connect_timeout,omitempty"`
+	// Attempts to connect again when no target server can be connected to, waiting `connect_retry_delay`
+	// before the first, doubled for every further attempt up to `connect_retry_max_delay`
+	ConnectRetries       int    `yaml:"connect_retries,omitempty"`
+	ConnectRetryDelay    string `yaml:"connect_retry_delay,omitempty"`
+	ConnectRetryMaxDelay string `yaml:"connect_retry_max_delay,omitempty"`
+}
+
+type TargetPoolConfig struct {
+	// One of `round-robin`, `least-connections` or `weighted`
+	Strategy    string             `yaml:"strategy,omitempty"`
+	Members     []TargetConfig     `yaml:"members,omitempty"`
+	HealthCheck *HealthCheckConfig `yaml:"health_check,omitempty"`
+
+	// Default `target_session_attrs` for sessions which do not ask for any, like libpq's
+	TargetSessionAttrs string `yaml:"target_session_attrs,omitempty"`
+	// Terminate sessions needing the primary when their target server is demoted
+	TerminateOnDemotion bool `yaml:"terminate_on_demotion,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Interval string `yaml:"interval,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+
+	// Credentials to log in to the target servers with
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Database string `yaml:"database,omitempty"`
+
+	// Consecutive failed or successful checks before a target is taken out of or put back into use
+	UnhealthyThreshold int `yaml:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int `yaml:"healthy_threshold,omitempty"`
 }
 
 type SSLConfig struct {
@@ -21,6 +70,90 @@ type SSLConfig struct {
 	Required    bool   `yaml:"required,omitempty"`
 	Certificate string `yaml:"certificate,omitempty"`
 	Key         string `yaml:"key,omitempty"`
+
+	// Client certificate verification
+	CA         string `yaml:"ca,omitempty"`
+	ClientAuth string `yaml:"client_auth,omitempty"`
+	CRL        string `yaml:"crl,omitempty"`
+}
+
+type AuthenticationRuleConfig struct {
+	// Name of the `authentication` plugin instance to use
+	Plugin string `yaml:"plugin,omitempty"`
+	// Reject matching sessions instead of authenticating them
+	Reject bool `yaml:"reject,omitempty"`
+
+	// Match conditions, unset conditions match everything
+	User     string `yaml:"user,omitempty"`
+	Database string `yaml:"database,omitempty"`
+	Address  string `yaml:"address,omitempty"`
+	SSL      *bool  `yaml:"ssl,omitempty"`
+}
+
+type HBAConfig struct {
+	// pg_hba.conf file to load
+	File string `yaml:"file,omitempty"`
+	// Map of pg_hba.conf authentication methods to `authentication` plugin instance names
+	Methods map[string]string `yaml:"methods,omitempty"`
+}
+
+type SessionInitConfig struct {
+	// Match conditions, unset conditions match everything
+	User       string `yaml:"user,omitempty"`
+	Database   string `yaml:"database,omitempty"`
+	Plugin     string `yaml:"plugin,omitempty"`
+	TargetUser string `yaml:"target_user,omitempty"`
+
+	// Run-time parameters to set, e.g. `search_path` or `statement_timeout`
+	Parameters map[string]string `yaml:"parameters,omitempty"`
+	// Statements to run, e.g. `SET ROLE analyst`
+	Statements []string `yaml:"statements,omitempty"`
+}
+
+type BruteForceConfig struct {
+	// Failures for a user or client address before further attempts are delayed
+	DelayAfter int `yaml:"delay_after,omitempty"`
+	// Initial delay, doubled for every further failure up to `max_delay`
+	Delay    string `yaml:"delay,omitempty"`
+	MaxDelay string `yaml:"max_delay,omitempty"`
+
+	// Failures for a user or client address before it is locked out
+	LockoutAfter int    `yaml:"lockout_after,omitempty"`
+	Lockout      string `yaml:"lockout,omitempty"`
+
+	// Failure counts are forgotten after this long without a failure
+	Window string `yaml:"window,omitempty"`
+}
+
+type PoolConfig struct {
+	// `transaction` shares target server connections between clients one transaction at a time,
+	// `session` reuses them for new clients once a client disconnects
+	Mode string `yaml:"mode,omitempty"`
+	// Maximum target server connections for each database and target user
+	Size int `yaml:"size,omitempty"`
+	// Connections kept open for each database and target user once it has been used
+	MinSize int `yaml:"min_size,omitempty"`
+	// Idle connections are closed after this long unused, and all connections after `max_lifetime`
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+	MaxLifetime string `yaml:"max_lifetime,omitempty"`
+	// How long clients wait for a connection when all of them are in use
+	WaitTimeout string `yaml:"wait_timeout,omitempty"`
+	// Query resetting a connection left by a client before another client uses it
+	ResetQuery string `yaml:"reset_query,omitempty"`
+}
+
+type DatabaseConfig struct {
+	// Database name on the target server, default the name the client connected with
+	Database string `yaml:"database,omitempty"`
+
+	// Target servers for the database, default the listener's
+	Target  *TargetConfig     `yaml:"target,omitempty"`
+	Targets *TargetPoolConfig `yaml:"targets,omitempty"`
+
+	// Plugins for the database, replacing the listener's
+	Authentication      map[string]ConfigMap       `yaml:"authentication,omitempty"`
+	AuthenticationRules []AuthenticationRuleConfig `yaml:"authentication_rules,omitempty"`
+	Logging             map[string]ConfigMap       `yaml:"logging,omitempty"`
 }
 
 type ConfigMap map[string]interface{}
@@ -67,11 +200,60 @@ func (c ConfigMap) BoolDefault(name string, d bool) bool {
 	return b
 }
 
+func (c ConfigMap) Duration(name string) (time.Duration, bool) {
+	s, ok := c.String(name)
+	if !ok {
+		return 0, false
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
+
+func (c ConfigMap) DurationDefault(name string, d time.Duration) time.Duration {
+	v, ok := c.Duration(name)
+	if !ok {
+		return d
+	}
+	return v
+}
+
 func (c ConfigMap) Map(name string) (ConfigMap, bool) {
 	raw, ok := c[name]
 	if !ok {
 		return nil, false
 	}
+	return toConfigMap(raw)
+}
+
+func (c ConfigMap) MapList(name string) ([]ConfigMap, bool) {
+	raw, ok := c[name]
+	if !ok {
+		return nil, false
+	}
+	values, ok := raw.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	l := make([]ConfigMap, 0, len(values))
+	for _, v := range values {
+		m, ok := toConfigMap(v)
+		if !ok {
+			return nil, false
+		}
+		l = append(l, m)
+	}
+	return l, true
+}
+
+func toConfigMap(raw interface{}) (ConfigMap, bool) {
+	if m, ok := raw.(ConfigMap); ok {
+		return m, true
+	}
 	value, ok := raw.(map[interface{}]interface{})
 	if !ok {
 		return nil, false
@@ -89,12 +271,18 @@ func (c ConfigMap) Map(name string) (ConfigMap, bool) {
 }
 
 type ListenerConfig struct {
-	Bind           string               `yaml:"bind,omitempty"`
-	SSL            SSLConfig            `yaml:"ssl,omitempty"`
-	Target         TargetConfig         `yaml:"target,omitempty"`
-	Authentication map[string]ConfigMap `yaml:"authentication,omitempty"`
-	Logging        map[string]ConfigMap `yaml:"logging,omitempty"`
-	Databases      map[string]ConfigMap `yaml:"databases,omitempty"`
+	Bind                string                     `yaml:"bind,omitempty"`
+	SSL                 SSLConfig                  `yaml:"ssl,omitempty"`
+	Target              TargetConfig               `yaml:"target,omitempty"`
+	Targets             *TargetPoolConfig          `yaml:"targets,omitempty"`
+	Authentication      map[string]ConfigMap       `yaml:"authentication,omitempty"`
+	AuthenticationRules []AuthenticationRuleConfig `yaml:"authentication_rules,omitempty"`
+	HBA                 HBAConfig                  `yaml:"hba,omitempty"`
+	BruteForce          *BruteForceConfig          `yaml:"brute_force,omitempty"`
+	SessionInit         []SessionInitConfig        `yaml:"session_init,omitempty"`
+	Pool                *PoolConfig                `yaml:"pool,omitempty"`
+	Logging             map[string]ConfigMap       `yaml:"logging,omitempty"`
+	Databases           map[string]*DatabaseConfig `yaml:"databases,omitempty"`
 }
 
 func NewConfig() *Config {
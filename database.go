@@ -0,0 +1,102 @@
+package pggateway
+
+// database is a database a listener accepts sessions for, with the target servers and plugins to use
+type database struct {
+	// Name on the target server, empty to keep the name the client connected with
+	name    string
+	targets *targetPool
+	plugins *PluginRegistry
+	// Pools of backends shared by sessions, nil without pooling
+	backends *backendPools
+}
+
+// newDatabase creates a `databases` entry, using the listener's target servers and plugins for anything it does not configure
+func (l *Listener) newDatabase(config *DatabaseConfig) (*database, error) {
+	d := &database{
+		targets: l.targets,
+		plugins: l.plugins,
+	}
+	if config != nil {
+		err := d.configure(l, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.config.Pool != nil {
+		var err error
+		d.backends, err = newBackendPools(*l.config.Pool, d.targets, d.plugins)
+		if err != nil {
+			return nil, err
+		}
+		d.plugins.backendPools = append(d.plugins.backendPools, d.backends)
+	}
+	return d, nil
+}
+
+// configure applies the options of a `databases` entry
+func (d *database) configure(l *Listener, config *DatabaseConfig) error {
+	d.name = config.Database
+
+	if config.Authentication != nil || config.AuthenticationRules != nil || config.Logging != nil {
+		auth := l.config.Authentication
+		rules := l.config.AuthenticationRules
+		if config.Authentication != nil {
+			// Rules name the listener's authentication instances, so they do not apply to the database's own
+			auth = config.Authentication
+			rules = config.AuthenticationRules
+		} else if config.AuthenticationRules != nil {
+			rules = config.AuthenticationRules
+		}
+		logging := l.config.Logging
+		if config.Logging != nil {
+			logging = config.Logging
+		}
+
+		var err error
+		d.plugins, err = NewPluginRegistry(auth, rules, logging)
+		if err != nil {
+			return err
+		}
+		if l.config.HBA.File != "" && config.Authentication == nil && config.AuthenticationRules == nil {
+			err = d.plugins.loadHBA(l.config.HBA)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if config.Target != nil || config.Targets != nil {
+		target := l.config.Target
+		if config.Target != nil {
+			target = *config.Target
+			// Like `targets` members, a target without SSL options of its own uses the listener's
+			if target.SSLMode == "" {
+				target.SSLMode = l.config.Target.SSLMode
+				target.SSLRootCert = l.config.Target.SSLRootCert
+				target.SSLCert = l.config.Target.SSLCert
+				target.SSLKey = l.config.Target.SSLKey
+				target.SSLServerName = l.config.Target.SSLServerName
+			}
+		}
+
+		var err error
+		d.targets, err = newTargetPool(target, config.Targets, d.plugins)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// database returns the `databases` entry for the database name, falling back to `*`
+func (l *Listener) database(name []byte) (*database, bool) {
+	d, ok := l.databases[string(name)]
+	if ok {
+		return d, true
+	}
+
+	d, ok = l.databases["*"]
+	return d, ok
+}
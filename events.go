@@ -0,0 +1,109 @@
+package pggateway
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+type AuthResult string
+
+const (
+	AuthResultSuccess AuthResult = "success"
+	// The plugin did not accept the client's credentials
+	AuthResultFailure AuthResult = "failure"
+	// The session was rejected by an authentication rule or pg_hba.conf before any plugin ran
+	AuthResultRejected AuthResult = "rejected"
+	// Too many failed authentications for the user or client address
+	AuthResultLockedOut AuthResult = "locked_out"
+	// Authentication could not complete, e.g. the client disconnected or the target server was unavailable
+	AuthResultError AuthResult = "error"
+)
+
+// AuthEvent describes the outcome of a session's authentication, delivered to logging plugins implementing AuthEventLogger
+type AuthEvent struct {
+	Time      time.Time
+	SessionID string
+
+	// Name of the authentication plugin instance and the method it used with the client, e.g. `md5` or `scram-sha-256`
+	Plugin string
+	Method string
+
+	User       string
+	Database   string
+	TargetUser string
+
+	ClientAddress     string
+	SSL               bool
+	TLSVersion        string
+	TLSCipherSuite    string
+	ClientCertificate string
+
+	Result AuthResult
+	Reason string
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+func newAuthEvent(user []byte, database []byte, client net.Conn, result AuthResult, reason string) *AuthEvent {
+	event := &AuthEvent{
+		Time:          time.Now(),
+		User:          string(user),
+		Database:      string(database),
+		ClientAddress: client.RemoteAddr().String(),
+		Result:        result,
+		Reason:        reason,
+	}
+
+	if conn, ok := client.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		event.SSL = true
+		event.TLSVersion = tlsVersionNames[state.Version]
+		event.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		if len(state.PeerCertificates) > 0 {
+			event.ClientCertificate = state.PeerCertificates[0].Subject.String()
+		}
+	}
+	return event
+}
+
+func (e *AuthEvent) AsMap() map[string]interface{} {
+	return map[string]interface{}{
+		"time":               e.Time.UTC().Format(time.RFC3339Nano),
+		"session_id":         e.SessionID,
+		"plugin":             e.Plugin,
+		"method":             e.Method,
+		"user":               e.User,
+		"database":           e.Database,
+		"target_user":        e.TargetUser,
+		"client":             e.ClientAddress,
+		"ssl":                e.SSL,
+		"tls_version":        e.TLSVersion,
+		"tls_cipher_suite":   e.TLSCipherSuite,
+		"client_certificate": e.ClientCertificate,
+		"result":             string(e.Result),
+		"reason":             e.Reason,
+	}
+}
+
+// logAuthEvent delivers an authentication event for the session to the logging plugins
+func (s *Session) logAuthEvent(result AuthResult, reason string) {
+	event := newAuthEvent(s.User, s.Database, s.client, result, reason)
+	event.SessionID = s.ID
+	event.Plugin = s.authPlugin
+	event.Method = s.authMethod
+	if result == AuthResultSuccess {
+		event.TargetUser = string(s.TargetUser())
+	}
+	s.plugins.LogAuthEvent(event)
+}
+
+// SetAuthMethod records the method used to authenticate the client, for plugins which do not request a password
+func (s *Session) SetAuthMethod(method string) {
+	s.authMethod = method
+}
@@ -0,0 +1,127 @@
+package pggateway
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLoggingPlugin discards log messages, like third party plugins which do not log authentication events
+type testLoggingPlugin struct{}
+
+func (p *testLoggingPlugin) LogInfo(LoggingContext, string, ...interface{})  {}
+func (p *testLoggingPlugin) LogDebug(LoggingContext, string, ...interface{}) {}
+func (p *testLoggingPlugin) LogError(LoggingContext, string, ...interface{}) {}
+func (p *testLoggingPlugin) LogFatal(LoggingContext, string, ...interface{}) {}
+func (p *testLoggingPlugin) LogWarn(LoggingContext, string, ...interface{})  {}
+
+func (p *testLoggingPlugin) MessageInspection() MessageInspection {
+	return MessageInspectionNone
+}
+
+// testAuthEventLogger records the authentication events it receives
+type testAuthEventLogger struct {
+	testLoggingPlugin
+
+	mutex  *sync.Mutex
+	events []*AuthEvent
+}
+
+func (p *testAuthEventLogger) LogAuthEvent(event *AuthEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events = append(p.events, event)
+}
+
+func (p *testAuthEventLogger) last() *AuthEvent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.events) == 0 {
+		return nil
+	}
+	return p.events[len(p.events)-1]
+}
+
+func TestAuthEventAsMap(t *testing.T) {
+	event := &AuthEvent{
+		Time:              time.Date(2024, 3, 1, 12, 30, 0, 5, time.FixedZone("CET", 3600)),
+		SessionID:         "session",
+		Plugin:            "users",
+		Method:            "scram-sha-256",
+		User:              "alice",
+		Database:          "app",
+		TargetUser:        "app_rw",
+		ClientAddress:     "10.0.0.1:50000",
+		SSL:               true,
+		TLSVersion:        "TLSv1.3",
+		TLSCipherSuite:    "TLS_AES_128_GCM_SHA256",
+		ClientCertificate: "CN=alice",
+		Result:            AuthResultSuccess,
+	}
+	expected := map[string]interface{}{
+		"time":               "2024-03-01T11:30:00.000000005Z",
+		"session_id":         "session",
+		"plugin":             "users",
+		"method":             "scram-sha-256",
+		"user":               "alice",
+		"database":           "app",
+		"target_user":        "app_rw",
+		"client":             "10.0.0.1:50000",
+		"ssl":                true,
+		"tls_version":        "TLSv1.3",
+		"tls_cipher_suite":   "TLS_AES_128_GCM_SHA256",
+		"client_certificate": "CN=alice",
+		"result":             "success",
+		"reason":             "",
+	}
+	if m := event.AsMap(); !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %#v, got %#v", expected, m)
+	}
+}
+
+func TestAuthEvents(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+
+	for _, test := range []struct {
+		name   string
+		plugin AuthenticationPlugin
+		rules  bool
+		result AuthResult
+		reason string
+	}{
+		{"success", &testLoginPlugin{}, false, AuthResultSuccess, ""},
+		{"failure", &testAuthPlugin{}, false, AuthResultFailure, "invalid credentials"},
+		{"rejected", &testLoginPlugin{}, true, AuthResultRejected, "no authentication rule matches session"},
+	} {
+		l := newTestListener(t, server, test.plugin, nil)
+		l.plugins.rulesConfigured = test.rules
+		logger := &testAuthEventLogger{mutex: &sync.Mutex{}}
+		// Logging plugins which do not implement AuthEventLogger are skipped
+		l.plugins.loggingPlugins["plain"] = &testLoggingPlugin{}
+		l.plugins.loggingPlugins["events"] = logger
+
+		connectTestClient(t, l)
+		event := logger.last()
+		if event == nil || event.Result != test.result || event.Reason != test.reason || event.User != "app" || event.Database != "app" {
+			t.Errorf("%s: expected a %#v event with reason %#v, got %#v", test.name, test.result, test.reason, event)
+			continue
+		}
+		if test.result != AuthResultRejected && (event.SessionID == "" || event.Plugin != "test") {
+			t.Errorf("%s: expected the event to name the session and plugin, got %#v", test.name, event)
+		}
+	}
+
+	// Locked out once the failure reached the threshold
+	l := newTestListener(t, server, &testAuthPlugin{}, &BruteForceConfig{DelayAfter: 5, LockoutAfter: 1})
+	logger := &testAuthEventLogger{mutex: &sync.Mutex{}}
+	l.plugins.loggingPlugins["events"] = logger
+	connectTestClient(t, l)
+	connectTestClient(t, l)
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	if len(logger.events) != 2 || logger.events[0].Result != AuthResultFailure || logger.events[1].Result != AuthResultLockedOut {
+		t.Fatalf("expected a failure then a locked out event, got %#v", logger.events)
+	}
+}
@@ -0,0 +1,295 @@
+package pggateway
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type hbaToken struct {
+	value  string
+	quoted bool
+}
+
+// loadHBARules parses a pg_hba.conf file into authentication rules.
+//
+// Only `host`, `hostssl`, `hostnossl` and `hostnogssenc` lines apply to the gateway, `local` and `hostgssenc` lines are ignored.
+// The `reject` method is built in, all other methods must be mapped to a plugin instance.
+func loadHBARules(config HBAConfig, plugins map[string]AuthenticationPlugin) ([]*authRule, error) {
+	f, err := os.Open(config.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := make([]*authRule, 0)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	line := ""
+	for scanner.Scan() {
+		lineNum++
+		text := scanner.Text()
+
+		// Lines ending in a backslash continue onto the next line
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\")
+			continue
+		}
+		line += text
+
+		fields, err := tokenizeHBALine(line)
+		line = ""
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", config.File, lineNum, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseHBALine(config, fields, plugins)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", config.File, lineNum, err)
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+func parseHBALine(config HBAConfig, fields [][]hbaToken, plugins map[string]AuthenticationPlugin) (*authRule, error) {
+	if len(fields[0]) != 1 {
+		return nil, fmt.Errorf("connection type must be a single value")
+	}
+
+	rule := &authRule{}
+	switch fields[0][0].value {
+	case "local", "hostgssenc":
+		// Never matches connections to the gateway
+		return nil, nil
+	case "host", "hostnogssenc":
+	case "hostssl":
+		ssl := true
+		rule.ssl = &ssl
+	case "hostnossl":
+		ssl := false
+		rule.ssl = &ssl
+	default:
+		return nil, fmt.Errorf("invalid connection type %#v", fields[0][0].value)
+	}
+
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("expected database, user, address and method")
+	}
+
+	dir := filepath.Dir(config.File)
+
+	// Database
+	databases, err := expandHBAIncludes(fields[1], dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	matchAll := false
+	onlyReplication := true
+	for _, t := range databases {
+		switch {
+		case !t.quoted && t.value == "all":
+			matchAll = true
+		case !t.quoted && t.value == "sameuser":
+			rule.sameUser = true
+		case !t.quoted && (t.value == "samerole" || t.value == "samegroup"):
+			return nil, fmt.Errorf("database keyword %#v is not supported", t.value)
+		case !t.quoted && t.value == "replication":
+			// Replication connections are not supported by the gateway
+			continue
+		default:
+			names = append(names, t.value)
+		}
+		onlyReplication = false
+	}
+	if onlyReplication {
+		return nil, nil
+	}
+	if matchAll {
+		rule.sameUser = false
+	} else if len(names) > 0 {
+		rule.database = namesToRegexp(names)
+	}
+
+	// User
+	users, err := expandHBAIncludes(fields[2], dir)
+	if err != nil {
+		return nil, err
+	}
+	names = nil
+	matchAll = false
+	for _, t := range users {
+		switch {
+		case !t.quoted && t.value == "all":
+			matchAll = true
+		case !t.quoted && strings.HasPrefix(t.value, "+"):
+			return nil, fmt.Errorf("group membership (%#v) is not supported", t.value)
+		default:
+			names = append(names, t.value)
+		}
+	}
+	if !matchAll {
+		rule.user = namesToRegexp(names)
+	}
+
+	// Address, as a CIDR block, an IP address followed by a mask, or `all`
+	if len(fields[3]) != 1 {
+		return nil, fmt.Errorf("address must be a single value")
+	}
+	methodIdx := 4
+	address := fields[3][0].value
+	switch {
+	case address == "all":
+	case address == "samehost" || address == "samenet":
+		return nil, fmt.Errorf("address keyword %#v is not supported", address)
+	case strings.Contains(address, "/"):
+		_, rule.network, err = net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %#v: %s", address, err)
+		}
+	default:
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %#v, host names are not supported", address)
+		}
+		mask := net.ParseIP(fields[4][0].value)
+		if mask == nil || len(fields) < 6 {
+			return nil, fmt.Errorf("IP address %#v must be followed by a mask", address)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, mask = ip4, mask.To4()
+		}
+		if mask == nil || len(mask) != len(ip) {
+			return nil, fmt.Errorf("IP address and mask do not match")
+		}
+		rule.network = &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+		methodIdx = 5
+	}
+
+	// Method, any options after the method are ignored
+	if len(fields[methodIdx]) != 1 {
+		return nil, fmt.Errorf("authentication method must be a single value")
+	}
+	method := fields[methodIdx][0].value
+	if method == "reject" {
+		rule.reject = true
+		return rule, nil
+	}
+
+	name, ok := config.Methods[method]
+	if !ok {
+		return nil, fmt.Errorf("authentication method %#v is not mapped to a plugin", method)
+	}
+	rule.name = name
+	rule.plugin, ok = plugins[name]
+	if !ok {
+		return nil, fmt.Errorf("authentication method %#v is mapped to unknown plugin %#v", method, name)
+	}
+	return rule, nil
+}
+
+// tokenizeHBALine splits a line into whitespace separated fields of comma separated tokens
+func tokenizeHBALine(line string) ([][]hbaToken, error) {
+	var fields [][]hbaToken
+	var field []hbaToken
+	var cur []byte
+	quoted := false
+	inQuotes := false
+	pending := false
+
+	endToken := func() {
+		if pending {
+			field = append(field, hbaToken{value: string(cur), quoted: quoted})
+		}
+		cur, quoted, pending = nil, false, false
+	}
+	endField := func() {
+		endToken()
+		if len(field) > 0 {
+			fields = append(fields, field)
+		}
+		field = nil
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuotes && c == '"':
+			inQuotes = false
+		case inQuotes:
+			cur = append(cur, c)
+		case c == '"':
+			inQuotes, quoted, pending = true, true, true
+		case c == '#':
+			i = len(line)
+		case c == ',':
+			endToken()
+			// A trailing comma continues the list in the next field
+			for i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '\t') {
+				i++
+			}
+		case c == ' ' || c == '\t':
+			endField()
+		default:
+			cur = append(cur, c)
+			pending = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	endField()
+	return fields, nil
+}
+
+// expandHBAIncludes replaces `@file` tokens with the names listed in the file, relative to the pg_hba.conf directory
+func expandHBAIncludes(tokens []hbaToken, dir string) ([]hbaToken, error) {
+	expanded := make([]hbaToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.quoted || !strings.HasPrefix(t.value, "@") {
+			expanded = append(expanded, t)
+			continue
+		}
+
+		filename := t.value[1:]
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			fields, err := tokenizeHBALine(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			for _, f := range fields {
+				expanded = append(expanded, f...)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// namesToRegexp builds a regular expression matching exactly one of the names
+func namesToRegexp(names []string) *regexp.Regexp {
+	quoted := make([]string, 0, len(names))
+	for _, n := range names {
+		quoted = append(quoted, regexp.QuoteMeta(n))
+	}
+	return regexp.MustCompile("^(?:" + strings.Join(quoted, "|") + ")$")
+}
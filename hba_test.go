@@ -0,0 +1,130 @@
+package pggateway
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func loadTestHBA(t *testing.T, dir string, content string) ([]*authRule, error) {
+	config := HBAConfig{
+		File:    writeTestFile(t, dir, "pg_hba.conf", []byte(content)),
+		Methods: map[string]string{"md5": "userlist"},
+	}
+	return loadHBARules(config, map[string]AuthenticationPlugin{"userlist": &testAuthPlugin{}})
+}
+
+func TestHBARules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-hba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestFile(t, dir, "admins", []byte("bob\n\"carol\" # comment\n"))
+	rules, err := loadTestHBA(t, dir, `
+# TYPE    DATABASE    USER      ADDRESS                      METHOD
+local     all         all                                    trust
+hostssl   all         all       10.0.0.0/8                   md5
+host      sameuser    all       192.168.1.0  255.255.255.0   md5
+host      "all"       alice     0.0.0.0/0                    md5
+host      app,\
+          "sameuser"  @admins   ::1/128                      md5
+host      all         all       172.16.0.5/32                reject
+host      replication all       all                          md5
+hostnossl all         "all"     172.16.0.0/16                md5  # a user named all
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 6 {
+		t.Fatalf("expected 6 rules, got %d", len(rules))
+	}
+	if !rules[4].reject {
+		t.Error("expected the reject line to reject sessions")
+	}
+
+	for _, test := range []struct {
+		user     string
+		database string
+		ip       string
+		ssl      bool
+		rule     int
+	}{
+		{"alice", "app", "10.1.2.3", true, 0},
+		{"alice", "app", "10.1.2.3", false, -1},
+		// `sameuser` with an address and mask
+		{"bob", "bob", "192.168.1.77", false, 1},
+		{"bob", "app", "192.168.1.77", false, -1},
+		{"bob", "bob", "192.168.2.1", false, -1},
+		// A quoted keyword is a name
+		{"alice", "all", "8.8.8.8", false, 2},
+		{"alice", "app", "8.8.8.8", false, -1},
+		{"all", "app", "172.16.0.6", false, 5},
+		{"bob", "app", "172.16.0.6", false, -1},
+		{"carol", "sameuser", "::1", false, 3},
+		{"carol", "carol", "::1", false, -1},
+		// Users from the included file
+		{"bob", "app", "::1", false, 3},
+		{"dave", "app", "::1", false, -1},
+		{"dave", "app", "172.16.0.5", false, 4},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.ip), Port: 5432}
+		matched := -1
+		for i, rule := range rules {
+			if rule.matches([]byte(test.user), []byte(test.database), addr, test.ssl) {
+				matched = i
+				break
+			}
+		}
+		if matched != test.rule {
+			t.Errorf("user %#v, database %#v from %s with ssl %v: expected rule %d, got %d", test.user, test.database, test.ip, test.ssl, test.rule, matched)
+		}
+	}
+}
+
+func TestHBAErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-hba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		line string
+		err  string
+	}{
+		{"host all +admins all md5", "group membership"},
+		{"host samerole all all md5", "\"samerole\" is not supported"},
+		{"host samegroup all all md5", "\"samegroup\" is not supported"},
+		{"host all all samehost md5", "\"samehost\" is not supported"},
+		{"host all all samenet md5", "\"samenet\" is not supported"},
+		{"host all all db.example.com md5", "host names are not supported"},
+		{"host all all 10.0.0.1 md5", "must be followed by a mask"},
+		{"host all all 10.0.0.1 ffff:: md5", "do not match"},
+		{"host all all 10.0.0.0/33 md5", "invalid address"},
+		{"host all all all ldap", "not mapped to a plugin"},
+		{"host all all all", "expected database, user, address and method"},
+		{"host all all all md5,md5", "single value"},
+		{"host \"all all all md5", "unterminated quoted string"},
+		{"hostx all all all md5", "invalid connection type"},
+		{"host all @missing all md5", "missing"},
+	} {
+		_, err := loadTestHBA(t, dir, test.line+"\n")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%#v: expected error %#v, got %v", test.line, test.err, err)
+		}
+	}
+
+	// Quoted, keywords and groups are names
+	rules, err := loadTestHBA(t, dir, "host \"samerole\" \"+admins\" all md5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+	if len(rules) != 1 || !rules[0].matches([]byte("+admins"), []byte("samerole"), addr, false) {
+		t.Error("expected quoted keywords to match the names")
+	}
+}
@@ -0,0 +1,167 @@
+package pggateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	user     string
+	password string
+	database string
+
+	unhealthyThreshold int
+	healthyThreshold   int
+}
+
+func newHealthCheck(config HealthCheckConfig) (*healthCheck, error) {
+	h := &healthCheck{
+		user:               config.User,
+		password:           config.Password,
+		database:           config.Database,
+		unhealthyThreshold: config.UnhealthyThreshold,
+		healthyThreshold:   config.HealthyThreshold,
+	}
+	if h.user == "" {
+		return nil, fmt.Errorf("'targets.health_check.user' configuration value is required")
+	}
+	if h.database == "" {
+		h.database = "postgres"
+	}
+	if h.unhealthyThreshold <= 0 {
+		h.unhealthyThreshold = 2
+	}
+	if h.healthyThreshold <= 0 {
+		h.healthyThreshold = 1
+	}
+
+	var err error
+	h.interval, err = parseDurationDefault(config.Interval, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health_check interval %#v: %s", config.Interval, err)
+	}
+	h.timeout, err = parseDurationDefault(config.Timeout, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health_check timeout %#v: %s", config.Timeout, err)
+	}
+
+	return h, nil
+}
+
+// run checks every member of the pool each interval until stopped
+func (h *healthCheck) run(pool *targetPool, stop chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		wg := &sync.WaitGroup{}
+		for _, m := range pool.members {
+			wg.Add(1)
+			go func(m *targetMember) {
+				defer wg.Done()
+				role, err := h.probe(m)
+				pool.setHealth(m, role, err)
+			}(m)
+		}
+		wg.Wait()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe logs in to the target server and checks whether it is the primary or a standby
+func (h *healthCheck) probe(m *targetMember) (string, error) {
+	dialer := *m.dialer
+	dialer.timeout = h.timeout
+	conn, err := dialer.dial(m.addr)
+	if err != nil {
+		return targetRoleUnknown, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(h.timeout))
+
+	startup := &pgproto.StartupMessage{
+		Options: map[string][]byte{
+			"user":             []byte(h.user),
+			"database":         []byte(h.database),
+			"application_name": []byte("pggateway health check"),
+		},
+	}
+	err = serverLogin(conn, startup, []byte(h.user), []byte(h.password))
+	if err != nil {
+		return targetRoleUnknown, err
+	}
+	_, err = waitForReady(conn)
+	if err != nil {
+		return targetRoleUnknown, err
+	}
+
+	err = writeMessage(conn, messageTypeQuery, []byte("SELECT pg_catalog.pg_is_in_recovery()\x00"))
+	if err != nil {
+		return targetRoleUnknown, err
+	}
+	inRecovery, err := waitForReady(conn)
+	if err != nil {
+		return targetRoleUnknown, err
+	}
+	writeMessage(conn, messageTypeTerminate, nil)
+
+	switch inRecovery {
+	case "f":
+		return targetRolePrimary, nil
+	case "t":
+		return targetRoleStandby, nil
+	}
+	return targetRoleUnknown, fmt.Errorf("unexpected pg_is_in_recovery() result %#v", inRecovery)
+}
+
+// waitForReady reads messages from the target server until it is ready for a query, returning the first column
+// of the last data row and any error response
+func waitForReady(conn net.Conn) (string, error) {
+	var value string
+	var failure error
+	for {
+		typ, payload, err := readMessage(conn)
+		if err != nil {
+			// Fatal errors are followed by the server closing the connection
+			if failure != nil {
+				return "", failure
+			}
+			return "", err
+		}
+
+		switch typ {
+		case messageTypeDataRow:
+			// Int16 column count, Int32 length of the first column (-1 for NULL), value
+			if len(payload) >= 6 {
+				length := int32(binary.BigEndian.Uint32(payload[2:]))
+				if length >= 0 && int(length) <= len(payload)-6 {
+					value = string(payload[6 : 6+length])
+				}
+			}
+		case messageTypeError:
+			failure = fmt.Errorf("server error: %s", errorMessageText(payload))
+		case messageTypeReadyForQuery:
+			return value, failure
+		}
+	}
+}
+
+func parseDurationDefault(value string, d time.Duration) (time.Duration, error) {
+	if value == "" {
+		return d, nil
+	}
+	return time.ParseDuration(value)
+}
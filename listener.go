@@ -5,16 +5,22 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"time"
 
 	"github.com/c653labs/pgproto"
 )
 
 type Listener struct {
-	l        net.Listener
-	config   *ListenerConfig
-	plugins  *PluginRegistry
-	stopping bool
+	l           net.Listener
+	config      *ListenerConfig
+	plugins     *PluginRegistry
+	tlsConfig   *tls.Config
+	certificate *serverCertificate
+	targets     *targetPool
+	bruteForce  *bruteForceTracker
+	sessionInit []*sessionInitRule
+	databases   map[string]*database
+	stopping    bool
 }
 
 func NewListener(config *ListenerConfig) *Listener {
@@ -27,15 +33,71 @@ func NewListener(config *ListenerConfig) *Listener {
 func (l *Listener) Listen() error {
 	l.stopping = false
 	var err error
-	l.plugins, err = NewPluginRegistry(l.config.Authentication, l.config.Logging)
+	l.plugins, err = NewPluginRegistry(l.config.Authentication, l.config.AuthenticationRules, l.config.Logging)
 	if err != nil {
 		return err
 	}
 
+	if l.config.HBA.File != "" {
+		err = l.plugins.loadHBA(l.config.HBA)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.config.BruteForce != nil {
+		l.bruteForce, err = newBruteForceTracker(*l.config.BruteForce)
+		if err != nil {
+			return err
+		}
+	}
+
+	l.targets, err = newTargetPool(l.config.Target, l.config.Targets, l.plugins)
+	if err != nil {
+		return err
+	}
+
+	l.sessionInit, err = newSessionInitRules(l.config.SessionInit)
+	if err != nil {
+		return err
+	}
+
+	if l.config.Pool != nil && len(l.config.SessionInit) > 0 {
+		return fmt.Errorf("'session_init' cannot be used with 'pool'")
+	}
+
+	l.databases = make(map[string]*database)
+	for name, config := range l.config.Databases {
+		l.databases[name], err = l.newDatabase(config)
+		if err != nil {
+			return fmt.Errorf("database %#v: %s", name, err)
+		}
+	}
+
+	if l.config.SSL.Enabled {
+		l.tlsConfig, err = newServerTLSConfig(l.config.SSL)
+		if err != nil {
+			return err
+		}
+		l.certificate, err = newServerCertificate(l.config.SSL)
+		if err != nil {
+			return err
+		}
+	}
+
 	l.l, err = net.Listen("tcp", l.config.Bind)
 	if err != nil {
 		return err
 	}
+	l.targets.start()
+	for _, d := range l.databases {
+		if d.targets != l.targets {
+			d.targets.start()
+		}
+		if d.backends != nil {
+			d.backends.start()
+		}
+	}
 
 	return nil
 }
@@ -45,6 +107,17 @@ func (l *Listener) Close() error {
 	if l.l != nil {
 		l.l.Close()
 	}
+	if l.targets != nil {
+		l.targets.close()
+	}
+	for _, d := range l.databases {
+		if d.targets != l.targets {
+			d.targets.close()
+		}
+		if d.backends != nil {
+			d.backends.close()
+		}
+	}
 	return nil
 }
 
@@ -72,43 +145,23 @@ func (l *Listener) Handle() error {
 	}
 }
 
-func (l *Listener) databaseAllowed(database []byte) bool {
-	_, ok := l.config.Databases[string(database)]
-	if ok {
-		return true
-	}
-
-	_, ok = l.config.Databases["*"]
-	return ok
-}
-
 func (l *Listener) handleClient(client net.Conn) error {
-	addr := net.JoinHostPort(l.config.Target.Host, strconv.Itoa(l.config.Target.Port))
-	server, err := net.Dial("tcp", addr)
-	if err != nil {
-		l.plugins.LogError(nil, "error connecting to server %#v: %s", addr, err)
-		return err
-	}
-
-	startup, err := pgproto.ParseStartupMessage(client)
-	if err != nil {
+	startup, err := l.readStartupMessage(client)
+	if startup == nil || err != nil {
 		return err
 	}
 
 	isSSL := false
+	var tlsServerEndPoint []byte
 	if startup.SSLRequest {
-		if !l.config.SSL.Enabled {
-			_, err := client.Write([]byte{'N'})
-			return err
-		}
-		client, err = l.upgradeSSLConnection(client)
+		client, tlsServerEndPoint, err = l.upgradeSSLConnection(client)
 		if err != nil {
 			return err
 		}
 
 		isSSL = true
-		startup, err = pgproto.ParseStartupMessage(client)
-		if err != nil {
+		startup, err = l.readStartupMessage(client)
+		if startup == nil || err != nil {
 			return err
 		}
 	} else if l.config.SSL.Required {
@@ -134,6 +187,16 @@ func (l *Listener) handleClient(client net.Conn) error {
 		return err
 	}
 
+	attrs, err := sessionAttrs(startup)
+	if err != nil {
+		errMsg := &pgproto.Error{
+			Severity: []byte("Fatal"),
+			Message:  []byte(err.Error()),
+		}
+		_, err = pgproto.WriteMessage(errMsg, client)
+		return err
+	}
+
 	if database, ok = startup.Options["database"]; !ok {
 		// No database was provided
 		errMsg := &pgproto.Error{
@@ -144,7 +207,8 @@ func (l *Listener) handleClient(client net.Conn) error {
 		return err
 	}
 
-	if !l.databaseAllowed(database) {
+	db, ok := l.database(database)
+	if !ok {
 		// Database is nto supported
 		errMsg := &pgproto.Error{
 			Severity: []byte("Fatal"),
@@ -153,43 +217,144 @@ func (l *Listener) handleClient(client net.Conn) error {
 		_, err = pgproto.WriteMessage(errMsg, client)
 		return err
 	}
-	sess, err := NewSession(startup, user, database, isSSL, client, server, l.plugins)
+	if db.name != "" {
+		// Sessions keep the client's database name, only the target server sees the rewritten one
+		startup.Options["database"] = []byte(db.name)
+	}
+
+	if rule, ok := db.plugins.matchAuthRule(user, database, client.RemoteAddr(), isSSL); ok && (rule == nil || rule.reject) {
+		encryption := "no encryption"
+		if isSSL {
+			encryption = "SSL encryption"
+		}
+		// Same message as PostgreSQL for connections not allowed by pg_hba.conf
+		format := "no pg_hba.conf entry for host %#v, user %#v, database %#v, %s"
+		if !db.plugins.rulesFromHBA {
+			format = "authentication rules do not allow host %#v, user %#v, database %#v, %s"
+		}
+		errMsg := &pgproto.Error{
+			Severity: []byte("Fatal"),
+			Message:  []byte(fmt.Sprintf(format, hostString(client.RemoteAddr()), string(user), string(database), encryption)),
+		}
+		reason := "no authentication rule matches session"
+		if rule != nil {
+			reason = "rejected by authentication rule"
+		}
+		db.plugins.LogAuthEvent(newAuthEvent(user, database, client, AuthResultRejected, reason))
+		_, err = pgproto.WriteMessage(errMsg, client)
+		return err
+	}
+
+	if l.bruteForce != nil {
+		if until, locked := l.bruteForce.lockedOut(user, client.RemoteAddr()); locked {
+			db.plugins.LogWarn(nil, "authentication of user %#v from %s locked out until %s", string(user), hostString(client.RemoteAddr()), until.Format(time.RFC3339))
+			db.plugins.LogAuthEvent(newAuthEvent(user, database, client, AuthResultLockedOut, "too many failed authentication attempts"))
+			errMsg := &pgproto.Error{
+				Severity: []byte("Fatal"),
+				Message:  []byte("too many failed authentication attempts"),
+			}
+			_, err = pgproto.WriteMessage(errMsg, client)
+			return err
+		}
+	}
+
+	if attrs == "" {
+		attrs = db.targets.sessionAttrs
+	}
+
+	sess, err := NewSession(startup, user, database, isSSL, client, nil, db.plugins)
 	if err != nil {
-		l.plugins.LogError(nil, "error creating new client session: %s", err)
+		db.plugins.LogError(nil, "error creating new client session: %s", err)
 		client.Close()
 		return err
 	}
 	defer sess.Close()
+	sess.tlsServerEndPoint = tlsServerEndPoint
+	sess.targetAttrs = attrs
+	// Until the session connects, the first target server is the one plugins are told about
+	sess.targetAddr = db.targets.members[0].addr
+	sess.targetDialer = db.targets.members[0].dialer
+	if db.backends != nil {
+		// The session shares backends from the database's pools
+		sess.backends = db.backends
+	} else {
+		// Connected once a plugin needs the target server, so rejected clients never open a connection to it
+		sess.targets = db.targets
+	}
+	return l.handleSession(db, sess)
+}
+
+// readStartupMessage reads the client's startup message or an SSLRequest when SSL is enabled, declining requests for encryption
+// the listener does not support until the client sends one of those. A cancel request is handled in its place and nil returned
+func (l *Listener) readStartupMessage(client net.Conn) (*pgproto.StartupMessage, error) {
+	for {
+		packet, err := readStartupPacket(client)
+		if err != nil {
+			return nil, err
+		}
+
+		switch startupCode(packet) {
+		case cancelRequestCode:
+			l.handleCancel(packet)
+			return nil, nil
+		case gssEncRequestCode:
+			// Clients carry on with SSL or without encryption, unless they require GSSAPI encryption
+			_, err = client.Write([]byte{'N'})
+		case sslRequestCode:
+			if l.config.SSL.Enabled {
+				return &pgproto.StartupMessage{SSLRequest: true}, nil
+			}
+			_, err = client.Write([]byte{'N'})
+		default:
+			return parseStartupPacket(client, packet)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// handleSession runs a new client session until it ends
+func (l *Listener) handleSession(db *database, sess *Session) error {
+	sess.bruteForce = l.bruteForce
+	sess.sessionInit = l.sessionInit
 
-	l.plugins.LogInfo(sess.loggingContext(), "new client session")
-	err = sess.Handle()
+	db.plugins.LogInfo(sess.loggingContext(), "new client session")
+	err := sess.Handle()
 
 	if err != nil && err != io.EOF {
-		l.plugins.LogError(sess.loggingContext(), "client session end: %s", err)
+		db.plugins.LogError(sess.loggingContext(), "client session end: %s", err)
 	} else {
-		l.plugins.LogInfo(sess.loggingContext(), "client session end")
+		db.plugins.LogInfo(sess.loggingContext(), "client session end")
 	}
 	return err
 }
 
-func (l *Listener) upgradeSSLConnection(client net.Conn) (net.Conn, error) {
-	_, err := client.Write([]byte{'S'})
+// upgradeSSLConnection upgrades the client connection to a TLS connection, returning the `tls-server-end-point`
+// channel binding data for the certificate it used
+func (l *Listener) upgradeSSLConnection(client net.Conn) (net.Conn, []byte, error) {
+	cert, endPoint, err := l.certificate.get()
+	if cert == nil {
+		return nil, nil, err
+	}
 	if err != nil {
-		return nil, err
+		l.plugins.LogWarn(nil, "error reloading ssl certificate, using the previous one: %s", err)
 	}
 
-	cer, err := tls.LoadX509KeyPair(l.config.SSL.Certificate, l.config.SSL.Key)
+	_, err = client.Write([]byte{'S'})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Upgrade the client connection to a TLS connection
-	sslClient := tls.Server(client, &tls.Config{
-		Certificates: []tls.Certificate{cer},
-	})
-	sslClient.Handshake()
+	config := l.tlsConfig.Clone()
+	config.Certificates = []tls.Certificate{*cert}
+	sslClient := tls.Server(client, config)
+	err = sslClient.Handshake()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return sslClient, nil
+	return sslClient, endPoint, nil
 }
 
 func (l *Listener) String() string {
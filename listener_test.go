@@ -0,0 +1,137 @@
+package pggateway
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/c653labs/pgproto"
+)
+
+// testLoginPlugin accepts every client, logging in to the target server with fixed credentials
+type testLoginPlugin struct{}
+
+func (p *testLoginPlugin) Authenticate(sess *Session, startup *pgproto.StartupMessage) (bool, error) {
+	err := sess.LoginToServer(startup, []byte("app"), []byte("password"))
+	return err == nil, err
+}
+
+func (p *testLoginPlugin) MessageInspection() MessageInspection {
+	return MessageInspectionNone
+}
+
+func newTestListener(t *testing.T, server *testBackendServer, plugin AuthenticationPlugin, bruteForce *BruteForceConfig) *Listener {
+	plugins, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins.authPlugins["test"] = plugin
+	plugins.authOrder = append(plugins.authOrder, "test")
+
+	addr := server.listener.Addr().(*net.TCPAddr)
+	targets, err := newTargetPool(TargetConfig{Host: "127.0.0.1", Port: addr.Port}, nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Listener{
+		config:    &ListenerConfig{},
+		plugins:   plugins,
+		targets:   targets,
+		databases: map[string]*database{"*": {targets: targets, plugins: plugins}},
+	}
+	if bruteForce != nil {
+		l.bruteForce, err = newBruteForceTracker(*bruteForce)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+// connectTestClient runs a client session through the listener, returning the types of the messages the client received
+func connectTestClient(t *testing.T, l *Listener) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		l.handleClient(conn)
+	}()
+
+	options := "user\x00app\x00database\x00app\x00\x00"
+	startup := make([]byte, 8, 8+len(options))
+	binary.BigEndian.PutUint32(startup, uint32(8+len(options)))
+	binary.BigEndian.PutUint32(startup[4:], protocolMajorVersion<<16)
+	_, err = client.Write(append(startup, options...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := ""
+	for {
+		typ, _, err := readMessage(client)
+		if err != nil {
+			return received
+		}
+		received += string(typ)
+		if typ == messageTypeReadyForQuery || typ == messageTypeError {
+			return received
+		}
+	}
+}
+
+func TestTargetConnectedAfterAuthentication(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	connections := func() int {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return server.conns
+	}
+
+	// Clients the plugin rejects never reach the target server
+	rejecting := newTestListener(t, server, &testAuthPlugin{}, &BruteForceConfig{DelayAfter: 5, LockoutAfter: 1})
+	if received := connectTestClient(t, rejecting); received != "E" || connections() != 0 {
+		t.Fatalf("expected the rejected client to get an error without connecting, got %#v after %d connections", received, connections())
+	}
+
+	// Nor do locked out clients, even once a plugin would accept them
+	rejecting.databases["*"].plugins.authPlugins["test"] = &testLoginPlugin{}
+	if received := connectTestClient(t, rejecting); received != "E" || connections() != 0 {
+		t.Fatalf("expected the locked out client to get an error without connecting, got %#v after %d connections", received, connections())
+	}
+
+	accepting := newTestListener(t, server, &testLoginPlugin{}, nil)
+	received := connectTestClient(t, accepting)
+	if received[len(received)-1] != messageTypeReadyForQuery || connections() != 1 {
+		t.Fatalf("expected the accepted client to log in to the target server, got %#v after %d connections", received, connections())
+	}
+}
+
+func TestTargetConnectFailure(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	l := newTestListener(t, server, &testLoginPlugin{}, &BruteForceConfig{DelayAfter: 5, LockoutAfter: 1})
+	server.listener.Close()
+
+	// The client is told why, and is not blamed for the target server being unavailable
+	for i := 0; i < 2; i++ {
+		if received := connectTestClient(t, l); received != "E" {
+			t.Fatalf("expected a connection failure error, got %#v", received)
+		}
+	}
+	if _, locked := l.bruteForce.lockedOut([]byte("app"), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}); locked {
+		t.Fatal("expected target server connection failures not to lock out the client")
+	}
+}
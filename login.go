@@ -0,0 +1,280 @@
+package pggateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/c653labs/pgproto"
+)
+
+// LoginToServer starts a new session with the target server using the client's startup options,
+// but with the provided user and password substituted in.
+//
+// Plaintext, MD5 and SCRAM-SHA-256 (with channel binding when the target connection uses SSL)
+// password requests from the server are supported. Once the server accepts the login the
+// AuthenticationOK is forwarded to the client and the session is ready to be proxied.
+//
+// When a CredentialProvider is set on the session it decides the user and password instead.
+func (s *Session) LoginToServer(startup *pgproto.StartupMessage, user []byte, password []byte) error {
+	if s.credentialProvider != nil {
+		var err error
+		user, password, err = s.credentialProvider(user)
+		if err != nil {
+			return err
+		}
+	}
+	s.targetUser = user
+
+	if s.target == nil && s.backends != nil {
+		return s.loginPooled(startup, user, password)
+	}
+	err := s.connectTarget()
+	if err != nil {
+		return err
+	}
+
+	startupReq := &pgproto.StartupMessage{
+		Options: map[string][]byte{
+			"user": user,
+		},
+	}
+	for k, v := range startup.Options {
+		if k == "user" {
+			continue
+		}
+		startupReq.Options[k] = v
+	}
+
+	err = s.login(startupReq, user, password)
+	if _, ok := err.(*serverLoginError); ok {
+		retried, retryErr := s.retryTargetSSL()
+		if retryErr != nil {
+			err = retryErr
+		} else if retried {
+			err = s.login(startupReq, user, password)
+		}
+	}
+	if e, ok := err.(*serverLoginError); ok {
+		writeMessage(s.client, messageTypeError, e.payload)
+	}
+	return err
+}
+
+func (s *Session) login(startupReq *pgproto.StartupMessage, user []byte, password []byte) error {
+	err := serverLogin(s.target, startupReq, user, password)
+	if err != nil {
+		return err
+	}
+	return writeAuthenticationMessage(s.client, int32(pgproto.AuthenticationMethodOK), nil)
+}
+
+// serverLogin sends the startup message on a new target server connection and answers its password requests,
+// returning once the server accepts the login
+func serverLogin(conn net.Conn, startupReq *pgproto.StartupMessage, user []byte, password []byte) error {
+	_, err := pgproto.WriteMessage(startupReq, conn)
+	if err != nil {
+		return err
+	}
+
+	for {
+		method, data, err := readServerAuthentication(conn)
+		if err != nil {
+			return err
+		}
+
+		switch method {
+		case int32(pgproto.AuthenticationMethodOK):
+			return nil
+		case int32(pgproto.AuthenticationMethodPlaintext):
+			_, err = pgproto.WriteMessage(&pgproto.PasswordMessage{Password: password}, conn)
+		case int32(pgproto.AuthenticationMethodMD5):
+			if len(data) != 4 {
+				return fmt.Errorf("malformed MD5 password request from server")
+			}
+			passwdReq := &pgproto.PasswordMessage{}
+			passwdReq.SetPassword(user, password, data)
+			_, err = pgproto.WriteMessage(passwdReq, conn)
+		case authenticationMethodSASL:
+			err = loginSCRAM(conn, password, data)
+		default:
+			return fmt.Errorf("unexpected password request method from server: %d", method)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loginSCRAM runs the client side of a SCRAM-SHA-256 exchange with the target server
+func loginSCRAM(conn net.Conn, password []byte, data []byte) error {
+	offered := make(map[string]bool)
+	for len(data) > 0 && data[0] != 0 {
+		var mechanism string
+		var err error
+		mechanism, data, err = readCString(data)
+		if err != nil {
+			return fmt.Errorf("malformed SASL request from server: %s", err)
+		}
+		offered[mechanism] = true
+	}
+
+	var channelBinding []byte
+	if sslConn, ok := conn.(*tls.Conn); ok {
+		state := sslConn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			channelBinding = tlsServerEndPoint(state.PeerCertificates[0])
+		}
+	}
+
+	mechanism := scramSHA256
+	gs2Header := "n,,"
+	switch {
+	case offered[scramSHA256Plus] && channelBinding != nil:
+		mechanism = scramSHA256Plus
+		gs2Header = "p=" + scramChannelBindingType + ",,"
+	case !offered[scramSHA256]:
+		return fmt.Errorf("server does not support %s", scramSHA256)
+	case channelBinding != nil:
+		// We support channel binding, but the server did not offer it
+		gs2Header = "y,,"
+		channelBinding = nil
+	default:
+		channelBinding = nil
+	}
+
+	clientNonce, err := scramNonce()
+	if err != nil {
+		return err
+	}
+	// The user name is taken from the startup message
+	clientFirstBare := "n=,r=" + clientNonce
+	clientFirst := gs2Header + clientFirstBare
+
+	initial := append([]byte(mechanism), 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(initial[len(mechanism)+1:], uint32(len(clientFirst)))
+	initial = append(initial, clientFirst...)
+	err = writeMessage(conn, messageTypePassword, initial)
+	if err != nil {
+		return err
+	}
+
+	method, serverFirst, err := readServerAuthentication(conn)
+	if err != nil {
+		return err
+	}
+	if method != authenticationMethodSASLContinue {
+		return fmt.Errorf("expected SASL continue from server, got method %d", method)
+	}
+
+	attrs, err := parseSCRAMAttributes(string(serverFirst))
+	if err != nil {
+		return err
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) {
+		return fmt.Errorf("invalid SCRAM nonce from server")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM salt from server: %s", err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return fmt.Errorf("invalid SCRAM iteration count from server")
+	}
+
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(gs2Header), channelBinding...))
+	clientFinalWithoutProof := "c=" + cbind + ",r=" + nonce
+	authMessage := []byte(clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof)
+
+	saltedPassword := scramSaltedPassword(password, salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	err = writeMessage(conn, messageTypePassword, []byte(clientFinal))
+	if err != nil {
+		return err
+	}
+
+	method, serverFinal, err := readServerAuthentication(conn)
+	if err != nil {
+		return err
+	}
+	if method != authenticationMethodSASLFinal {
+		return fmt.Errorf("expected SASL final from server, got method %d", method)
+	}
+
+	attrs, err = parseSCRAMAttributes(string(serverFinal))
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication with server failed: %s", e)
+	}
+	serverSignature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("invalid SCRAM server signature: %s", err)
+	}
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+	if !hmac.Equal(serverSignature, scramHMAC(serverKey, authMessage)) {
+		return fmt.Errorf("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+// serverLoginError is an error response from the target server during login
+type serverLoginError struct {
+	payload []byte
+}
+
+func (e *serverLoginError) Error() string {
+	return fmt.Sprintf("server rejected login: %s", errorMessageText(e.payload))
+}
+
+// retryTargetSSL replaces the target server connection with an SSL connection after the server rejected a non-SSL login,
+// when `sslmode: allow` retries it. It reports whether the login is to be retried
+func (s *Session) retryTargetSSL() (bool, error) {
+	if s.targetDialer == nil || !s.targetDialer.retrySSL(s.target) {
+		return false, nil
+	}
+	s.LogInfo("target server rejected non-SSL login, retrying with SSL")
+	target, err := s.targetDialer.dialSSL(s.targetAddr)
+	if err != nil {
+		return false, err
+	}
+	s.setTarget(target, s.targetAddr)
+	return true, nil
+}
+
+// readServerAuthentication reads the next authentication request from the target server.
+// Error responses from the server are returned as a *serverLoginError.
+func readServerAuthentication(conn net.Conn) (int32, []byte, error) {
+	typ, payload, err := readMessage(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch typ {
+	case messageTypeAuthentication:
+		if len(payload) < 4 {
+			return 0, nil, fmt.Errorf("malformed authentication request from server")
+		}
+		return int32(binary.BigEndian.Uint32(payload)), payload[4:], nil
+	case messageTypeError:
+		return 0, nil, &serverLoginError{payload: payload}
+	}
+	return 0, nil, fmt.Errorf("unexpected response type %#v from server", string(typ))
+}
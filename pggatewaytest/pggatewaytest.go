@@ -0,0 +1,115 @@
+// Package pggatewaytest provides a client and target server for testing authentication plugins
+package pggatewaytest
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+// Target stands in for a target server, accepting any login and reporting the startup options it was sent
+type Target struct {
+	Listener net.Listener
+	Startups chan map[string]string
+}
+
+func NewTarget(t testing.TB) *Target {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{Listener: l, Startups: make(chan map[string]string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go target.serve(conn)
+		}
+	}()
+	return target
+}
+
+func (target *Target) Addr() string {
+	return target.Listener.Addr().String()
+}
+
+func (target *Target) Close() {
+	target.Listener.Close()
+}
+
+func (target *Target) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 4)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header)-4)
+	_, err = io.ReadFull(conn, packet)
+	if err != nil {
+		return
+	}
+	options := make(map[string]string)
+	fields := strings.Split(string(packet[4:]), "\x00")
+	for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+		options[fields[i]] = fields[i+1]
+	}
+	target.Startups <- options
+
+	// AuthenticationOk
+	conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
+	io.Copy(ioutil.Discard, conn)
+}
+
+// NewSession returns an SSL session connected to the target server for a client with the startup options,
+// which answers a password request with the password. The session's user and database are the `user` and `database` options
+func NewSession(t testing.TB, target *Target, options map[string]string, password string) (*pggateway.Session, *pgproto.StartupMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// Answer the password request, then ignore what the session sends
+		msg := make([]byte, 5, 6+len(password))
+		msg[0] = 'p'
+		binary.BigEndian.PutUint32(msg[1:], uint32(5+len(password)))
+		client.Write(append(append(msg, password...), 0))
+		io.Copy(ioutil.Discard, client)
+		client.Close()
+	}()
+
+	targetConn, err := net.Dial("tcp", target.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := pggateway.NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startup := &pgproto.StartupMessage{Options: make(map[string][]byte)}
+	for k, v := range options {
+		startup.Options[k] = []byte(v)
+	}
+	sess, err := pggateway.NewSession(startup, startup.Options["user"], startup.Options["database"], true, conn, targetConn, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess, startup
+}
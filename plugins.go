@@ -2,6 +2,9 @@ package pggateway
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/c653labs/pgproto"
@@ -31,6 +34,46 @@ type LoggingPlugin interface {
 	LogWarn(LoggingContext, string, ...interface{})
 }
 
+// AuthEventLogger is implemented by logging plugins to receive the outcome of every authentication as an AuthEvent
+type AuthEventLogger interface {
+	Plugin
+	LogAuthEvent(*AuthEvent)
+}
+
+// MessageInspection is how closely sessions look at protocol messages once they are authenticated
+type MessageInspection int
+
+const (
+	// Bytes are copied between the client and target server as they are
+	MessageInspectionNone MessageInspection = iota
+	// Messages are framed by their type and length, payloads are passed through unparsed
+	MessageInspectionFrames
+	// Messages are fully parsed
+	MessageInspectionFull
+)
+
+// ParseMessageInspection parses a plugin's option for how closely messages are inspected: "full", "frames" or "none"
+func ParseMessageInspection(value string) (MessageInspection, error) {
+	switch strings.ToLower(value) {
+	case "full":
+		return MessageInspectionFull, nil
+	case "frames":
+		return MessageInspectionFrames, nil
+	case "none":
+		return MessageInspectionNone, nil
+	}
+	return MessageInspectionNone, fmt.Errorf("unknown message inspection %#v, expected 'full', 'frames' or 'none'", value)
+}
+
+// MessageInspectingPlugin is implemented by plugins to declare how closely they need the protocol messages of authenticated sessions,
+// sessions use the closest inspection asked for by any of their plugins. Plugins which do not implement it get full inspection.
+type MessageInspectingPlugin interface {
+	Plugin
+	// MessageInspection returns how closely the plugin looks at messages once the session is authenticated,
+	// MessageInspectionNone when it does not look at them at all
+	MessageInspection() MessageInspection
+}
+
 func RegisterAuthPlugin(name string, init authPluginInitializer) {
 	authPlugins[name] = init
 }
@@ -48,28 +91,49 @@ type loggingMessage struct {
 
 type PluginRegistry struct {
 	authPlugins    map[string]AuthenticationPlugin
+	authOrder      []string
+	authRules      []*authRule
 	loggingPlugins map[string]LoggingPlugin
 	logMutex       *sync.Mutex
+
+	// Set when authentication rules or an hba file are configured, sessions no rule matches are then rejected
+	rulesConfigured bool
+	rulesFromHBA    bool
+
+	// Backend pools of every database using the plugins, which may hold connections logged in with credentials from them
+	backendPools []*backendPools
 }
 
-func NewPluginRegistry(auth map[string]ConfigMap, logging map[string]ConfigMap) (*PluginRegistry, error) {
+// NewPluginRegistry creates the configured plugin instances.
+//
+// Authentication plugin instances are keyed by name, the plugin to use defaults to the instance name
+// and can be set with the `plugin` option so the same plugin can be configured more than once.
+func NewPluginRegistry(auth map[string]ConfigMap, rules []AuthenticationRuleConfig, logging map[string]ConfigMap) (*PluginRegistry, error) {
 	r := &PluginRegistry{
 		authPlugins:    make(map[string]AuthenticationPlugin),
+		authOrder:      make([]string, 0),
+		authRules:      make([]*authRule, 0),
 		loggingPlugins: make(map[string]LoggingPlugin),
 		logMutex:       &sync.Mutex{},
 	}
 
 	for name, config := range auth {
-		init, ok := authPlugins[name]
-		if !ok {
-			return nil, fmt.Errorf("could not find authentication plugin: %s", name)
+		p, err := NewAuthenticationPlugin(config.StringDefault("plugin", name), config)
+		if err != nil {
+			return nil, err
 		}
+		r.authPlugins[name] = p
+		r.authOrder = append(r.authOrder, name)
+	}
+	sort.Strings(r.authOrder)
 
-		p, err := init(config)
+	r.rulesConfigured = rules != nil
+	for _, config := range rules {
+		rule, err := newAuthRule(config, r.authPlugins)
 		if err != nil {
 			return nil, err
 		}
-		r.authPlugins[name] = p
+		r.authRules = append(r.authRules, rule)
 	}
 
 	for name, config := range logging {
@@ -88,6 +152,16 @@ func NewPluginRegistry(auth map[string]ConfigMap, logging map[string]ConfigMap)
 	return r, nil
 }
 
+// NewAuthenticationPlugin creates an instance of a registered authentication plugin,
+// allowing plugins to wrap another authentication plugin.
+func NewAuthenticationPlugin(name string, config ConfigMap) (AuthenticationPlugin, error) {
+	init, ok := authPlugins[name]
+	if !ok {
+		return nil, fmt.Errorf("could not find authentication plugin: %s", name)
+	}
+	return init(config)
+}
+
 func (r *PluginRegistry) handleLog(msg loggingMessage) {
 	r.logMutex.Lock()
 	for _, p := range r.loggingPlugins {
@@ -107,9 +181,51 @@ func (r *PluginRegistry) handleLog(msg loggingMessage) {
 	r.logMutex.Unlock()
 }
 
-func (r *PluginRegistry) Authenticate(sess *Session, startup *pgproto.StartupMessage) (bool, error) {
+// messageInspection returns the closest inspection of protocol messages any of the plugins needs
+func (r *PluginRegistry) messageInspection() MessageInspection {
+	plugins := make([]Plugin, 0, len(r.authPlugins)+len(r.loggingPlugins))
 	for _, p := range r.authPlugins {
-		success, err := p.Authenticate(sess, startup)
+		plugins = append(plugins, p)
+	}
+	for _, p := range r.loggingPlugins {
+		plugins = append(plugins, p)
+	}
+
+	inspection := MessageInspectionNone
+	for _, p := range plugins {
+		pluginInspection := MessageInspectionFull
+		if p, ok := p.(MessageInspectingPlugin); ok {
+			pluginInspection = p.MessageInspection()
+		}
+		if pluginInspection > inspection {
+			inspection = pluginInspection
+		}
+	}
+	return inspection
+}
+
+// Authenticate authenticates the session using the first matching authentication rule.
+// Without any rules each plugin instance is tried in name order until one succeeds.
+func (r *PluginRegistry) Authenticate(sess *Session, startup *pgproto.StartupMessage) (bool, error) {
+	if rule, ok := r.matchAuthRule(sess.User, sess.Database, sess.client.RemoteAddr(), sess.IsSSL); ok {
+		if rule == nil {
+			r.LogInfo(sess.loggingContext(), "no authentication rule matches session")
+			sess.authFailure = "no authentication rule matches session"
+			return false, nil
+		}
+		if rule.reject {
+			r.LogInfo(sess.loggingContext(), "session rejected by authentication rule")
+			sess.authFailure = "rejected by authentication rule"
+			return false, nil
+		}
+		r.LogDebug(sess.loggingContext(), "authenticating with plugin %#v", rule.name)
+		sess.authPlugin = rule.name
+		return rule.plugin.Authenticate(sess, startup)
+	}
+
+	for _, name := range r.authOrder {
+		sess.authPlugin = name
+		success, err := r.authPlugins[name].Authenticate(sess, startup)
 		if err != nil {
 			return false, err
 		}
@@ -121,6 +237,48 @@ func (r *PluginRegistry) Authenticate(sess *Session, startup *pgproto.StartupMes
 	return false, nil
 }
 
+// loadHBA replaces the authentication rules with the rules from a pg_hba.conf file
+func (r *PluginRegistry) loadHBA(config HBAConfig) error {
+	if r.rulesConfigured {
+		return fmt.Errorf("only one of 'authentication_rules' or 'hba' can be configured")
+	}
+
+	rules, err := loadHBARules(config, r.authPlugins)
+	if err != nil {
+		return err
+	}
+	r.authRules = rules
+	r.rulesConfigured = true
+	r.rulesFromHBA = true
+	return nil
+}
+
+// matchAuthRule returns the first authentication rule matching the connection, or nil if none match.
+// The second return value is false when no authentication rules are configured, an empty list of rules matches nothing.
+func (r *PluginRegistry) matchAuthRule(user []byte, database []byte, addr net.Addr, isSSL bool) (*authRule, bool) {
+	if !r.rulesConfigured {
+		return nil, false
+	}
+
+	for _, rule := range r.authRules {
+		if rule.matches(user, database, addr, isSSL) {
+			return rule, true
+		}
+	}
+	return nil, true
+}
+
+// LogAuthEvent delivers an authentication event to all logging plugins implementing AuthEventLogger
+func (r *PluginRegistry) LogAuthEvent(event *AuthEvent) {
+	r.logMutex.Lock()
+	for _, p := range r.loggingPlugins {
+		if p, ok := p.(AuthEventLogger); ok {
+			p.LogAuthEvent(event)
+		}
+	}
+	r.logMutex.Unlock()
+}
+
 func (r *PluginRegistry) LogInfo(context LoggingContext, msg string, args ...interface{}) {
 	r.handleLog(loggingMessage{
 		level:   "info",
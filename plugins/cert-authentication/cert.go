@@ -0,0 +1,119 @@
+package cert
+
+import (
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+type rule struct {
+	field    string
+	match    *regexp.Regexp
+	user     string
+	password string
+}
+
+type CertAuth struct {
+	rules []rule
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("cert", newCertPlugin)
+}
+
+func newCertPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	auth := &CertAuth{}
+
+	rules, ok := config.MapList("rules")
+	if !ok || len(rules) == 0 {
+		return nil, fmt.Errorf("'rules' configuration value is required")
+	}
+
+	for i, r := range rules {
+		field := strings.ToLower(r.StringDefault("field", "cn"))
+		switch field {
+		case "cn", "dns", "email", "uri":
+		default:
+			return nil, fmt.Errorf("'rules[%d].field' must be one of 'cn', 'dns', 'email' or 'uri'", i)
+		}
+
+		match, ok := r.String("match")
+		if !ok {
+			return nil, fmt.Errorf("'rules[%d].match' configuration value is required", i)
+		}
+		re, err := regexp.Compile("^(?:" + match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("'rules[%d].match' is invalid: %s", i, err)
+		}
+
+		user, ok := r.String("user")
+		if !ok {
+			return nil, fmt.Errorf("'rules[%d].user' configuration value is required", i)
+		}
+
+		auth.rules = append(auth.rules, rule{
+			field:    field,
+			match:    re,
+			user:     user,
+			password: r.StringDefault("password", ""),
+		})
+	}
+
+	return auth, nil
+}
+
+func (p *CertAuth) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
+func (p *CertAuth) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	if !sess.IsSSL {
+		return false, fmt.Errorf("cert auth requires an SSL session")
+	}
+
+	sess.SetAuthMethod("cert")
+	cert := sess.ClientCertificate()
+	if cert == nil {
+		return false, nil
+	}
+
+	for _, r := range p.rules {
+		for _, value := range certificateValues(cert, r.field) {
+			if !r.match.MatchString(value) {
+				continue
+			}
+
+			// Expand capture groups from the match into the database user, e.g. `svc_$1`
+			user := r.match.ReplaceAllString(value, r.user)
+			err := sess.LoginToServer(startup, []byte(user), []byte(r.password))
+			if err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func certificateValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "cn":
+		return []string{cert.Subject.CommonName}
+	case "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		values := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+		return values
+	}
+	return nil
+}
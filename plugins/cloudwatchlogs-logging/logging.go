@@ -34,6 +34,8 @@ type LoggingPlugin struct {
 	stream string
 	token  *string
 	level  logLevel
+
+	inspection pggateway.MessageInspection
 }
 
 func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
@@ -64,6 +66,15 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		return nil, fmt.Errorf("unknown logging level: %#v", level)
 	}
 
+	inspection, err := pggateway.ParseMessageInspection(config.StringDefault("messages", "full"))
+	if err != nil {
+		return nil, err
+	}
+	if level > LevelDebug {
+		// Messages are only logged at the debug level
+		inspection = pggateway.MessageInspectionNone
+	}
+
 	group, ok := config.String("group")
 	if !ok {
 		return nil, fmt.Errorf("must supply 'group' parameter")
@@ -109,9 +120,15 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		group:  group,
 		stream: stream,
 		token:  token,
+
+		inspection: inspection,
 	}, nil
 }
 
+func (l *LoggingPlugin) MessageInspection() pggateway.MessageInspection {
+	return l.inspection
+}
+
 func (l *LoggingPlugin) putLogEvent(level logLevel, context pggateway.LoggingContext, msg string, args ...interface{}) error {
 	if level < l.level {
 		return nil
@@ -174,3 +191,11 @@ func (l *LoggingPlugin) LogFatal(context pggateway.LoggingContext, msg string, a
 func (l *LoggingPlugin) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
 	l.putLogEvent(LevelWarn, context, msg, args...)
 }
+
+func (l *LoggingPlugin) LogAuthEvent(event *pggateway.AuthEvent) {
+	level := LevelInfo
+	if event.Result != pggateway.AuthResultSuccess {
+		level = LevelWarn
+	}
+	l.putLogEvent(level, pggateway.LoggingContext(event.AsMap()), "authentication %s", event.Result)
+}
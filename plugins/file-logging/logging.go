@@ -16,7 +16,8 @@ func init() {
 }
 
 type LoggingPlugin struct {
-	log zerolog.Logger
+	log        zerolog.Logger
+	inspection pggateway.MessageInspection
 }
 
 func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
@@ -58,11 +59,25 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		return nil, err
 	}
 
+	inspection, err := pggateway.ParseMessageInspection(config.StringDefault("messages", "full"))
+	if err != nil {
+		return nil, err
+	}
+	if level > zerolog.DebugLevel {
+		// Messages are only logged at the debug level
+		inspection = pggateway.MessageInspectionNone
+	}
+
 	return &LoggingPlugin{
-		log: zerolog.New(outFile).Level(level).With().Timestamp().Logger(),
+		log:        zerolog.New(outFile).Level(level).With().Timestamp().Logger(),
+		inspection: inspection,
 	}, nil
 }
 
+func (l *LoggingPlugin) MessageInspection() pggateway.MessageInspection {
+	return l.inspection
+}
+
 func (l *LoggingPlugin) logMsg(e *zerolog.Event, context pggateway.LoggingContext, msg string, args ...interface{}) {
 	if !e.Enabled() {
 		return
@@ -93,3 +108,15 @@ func (l *LoggingPlugin) LogFatal(context pggateway.LoggingContext, msg string, a
 func (l *LoggingPlugin) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
 	l.logMsg(l.log.Warn(), context, msg, args...)
 }
+
+func (l *LoggingPlugin) LogAuthEvent(event *pggateway.AuthEvent) {
+	e := l.log.Info()
+	if event.Result != pggateway.AuthResultSuccess {
+		e = l.log.Warn()
+	}
+	if !e.Enabled() {
+		return
+	}
+
+	e.Fields(map[string]interface{}{"auth_event": event.AsMap()}).Msgf("authentication %s", event.Result)
+}
@@ -2,20 +2,44 @@ package iam
 
 import (
 	"fmt"
+	"regexp"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/c653labs/pggateway"
 	"github.com/c653labs/pgproto"
 )
 
+type rule struct {
+	principal *regexp.Regexp
+	tags      map[string]string
+	user      string
+	password  string
+}
+
 type IAMAuth struct {
 	roleArn    string
 	dbUser     string
 	dbPassword string
-	dbSSL      bool
+	rules      []rule
+
+	region      string
+	stsEndpoint string
+	iamEndpoint string
+
+	// Mint RDS IAM authentication tokens for the target server login instead of using static passwords
+	rdsIAM      bool
+	rdsRegion   string
+	rdsEndpoint string
+
+	// The gateway's own AWS credentials for tag lookups and RDS tokens, nil uses the default credential chain
+	credentials *credentials.Credentials
 }
 
 func init() {
@@ -30,22 +54,76 @@ func newIAMPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, e
 	if !ok {
 		return nil, fmt.Errorf("'role' configuration value is required")
 	}
+	if _, err := arn.Parse(auth.roleArn); err != nil {
+		return nil, fmt.Errorf("'role' is not a valid ARN: %s", err)
+	}
+
+	rules, _ := config.MapList("rules")
+	for i, r := range rules {
+		principal := r.StringDefault("principal", "*")
+		re, err := pggateway.GlobToRegexp(principal)
+		if err != nil {
+			return nil, fmt.Errorf("'rules[%d].principal' is invalid: %s", i, err)
+		}
+
+		tags := make(map[string]string)
+		tagMap, _ := r.Map("tags")
+		for k := range tagMap {
+			v, ok := tagMap.String(k)
+			if !ok {
+				return nil, fmt.Errorf("'rules[%d].tags.%s' must be a string", i, k)
+			}
+			tags[k] = v
+		}
+
+		user, ok := r.String("user")
+		if !ok {
+			return nil, fmt.Errorf("'rules[%d].user' configuration value is required", i)
+		}
+		auth.rules = append(auth.rules, rule{
+			principal: re,
+			tags:      tags,
+			user:      user,
+			password:  r.StringDefault("password", ""),
+		})
+	}
+
+	auth.region = config.StringDefault("region", "us-east-1")
+	endpoints, _ := config.Map("endpoints")
+	auth.stsEndpoint = endpoints.StringDefault("sts", "")
+	auth.iamEndpoint = endpoints.StringDefault("iam", "")
+
+	if _, ok := config["rds_iam"]; ok {
+		rdsIAM, _ := config.Map("rds_iam")
+		auth.rdsIAM = true
+		auth.rdsRegion = rdsIAM.StringDefault("region", auth.region)
+		auth.rdsEndpoint = rdsIAM.StringDefault("endpoint", "")
+	}
 
 	db, ok := config.Map("db")
-	if !ok {
+	if !ok && len(auth.rules) == 0 {
 		return nil, fmt.Errorf("'db' configuration value is required")
 	}
+	if ok {
+		auth.dbUser, ok = db.String("user")
+		if !ok {
+			return nil, fmt.Errorf("'db.user' configuration value is required")
+		}
+		auth.dbPassword = db.StringDefault("password", "")
 
-	auth.dbUser, ok = db.String("user")
-	if !ok {
-		return nil, fmt.Errorf("'db.user' configuration value is required")
+		// SSL to the target server is configured for the whole listener now
+		if _, ok := db["ssl"]; ok {
+			return nil, fmt.Errorf("'db.ssl' is no longer supported, set 'sslmode' in the listener's 'target' options instead")
+		}
 	}
-	auth.dbPassword = db.StringDefault("password", "")
-	auth.dbSSL = db.BoolDefault("ssl", true)
 
 	return auth, nil
 }
 
+func (p *IAMAuth) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
 func (p *IAMAuth) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
 	// We are passing through IAM credentials... don't let people do silly things
 	if !sess.IsSSL {
@@ -57,56 +135,178 @@ func (p *IAMAuth) Authenticate(sess *pggateway.Session, startup *pgproto.Startup
 		return false, err
 	}
 
-	awsSess := session.Must(session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentialsFromCreds(credentials.Value{
-			AccessKeyID:     string(startup.Options["user"]),
-			SecretAccessKey: string(passwd.Password),
-		}),
-	}))
-	client := iam.New(awsSess)
-	_, err = client.GetUser(nil)
+	stsClient, err := p.clientSTS(string(startup.Options["user"]), string(passwd.Password))
 	if err != nil {
 		return false, err
 	}
+	identity, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		sess.LogInfo("IAM credentials rejected: %s", err)
+		return false, nil
+	}
+	callerArn := aws.StringValue(identity.Arn)
 
-	startupReq := &pgproto.StartupMessage{
-		SSLRequest: p.dbSSL,
-		Options: map[string][]byte{
-			"user": []byte(p.dbUser),
-		},
+	allowed, err := p.checkRole(stsClient, callerArn, sess.ID)
+	if err != nil {
+		return false, err
 	}
-	for k, v := range startup.Options {
-		if k == "user" {
-			continue
+	if !allowed {
+		sess.LogInfo("IAM principal %#v cannot assume role %#v", callerArn, p.roleArn)
+		return false, nil
+	}
+
+	user, password, ok, err := p.databaseCredentials(callerArn)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		sess.LogInfo("IAM principal %#v does not match any rule", callerArn)
+		return false, nil
+	}
+
+	if p.rdsIAM {
+		endpoint := p.rdsEndpoint
+		if endpoint == "" {
+			endpoint = sess.TargetAddress()
+		}
+		password, err = p.rdsAuthToken(endpoint, user)
+		if err != nil {
+			return false, err
 		}
-		startupReq.Options[k] = v
 	}
-	err = sess.WriteToServer(startupReq)
+
+	err = sess.LoginToServer(startup, []byte(user), []byte(password))
 	if err != nil {
 		return false, err
 	}
+	return true, nil
+}
 
-	srvMsg, err := sess.ParseServerResponse()
+// clientSTS returns an STS client using the client's credentials, the password is the secret access key
+// or `<secret access key>:<session token>` for temporary credentials
+func (p *IAMAuth) clientSTS(accessKey string, password string) (*sts.STS, error) {
+	secret, token := password, ""
+	if i := strings.IndexByte(secret, ':'); i != -1 {
+		secret, token = secret[:i], secret[i+1:]
+	}
+
+	awsSess, err := session.NewSession(&aws.Config{
+		Region: aws.String(p.region),
+		Credentials: credentials.NewStaticCredentialsFromCreds(credentials.Value{
+			AccessKeyID:     accessKey,
+			SecretAccessKey: secret,
+			SessionToken:    token,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(awsSess, p.serviceConfig(p.stsEndpoint)), nil
+}
+
+// rdsAuthToken mints a short lived RDS IAM authentication token for the database user, signed with the gateway's own credentials
+func (p *IAMAuth) rdsAuthToken(endpoint string, user string) (string, error) {
+	awsSess, err := session.NewSession(&aws.Config{Region: aws.String(p.rdsRegion), Credentials: p.credentials})
+	if err != nil {
+		return "", err
+	}
+	return rdsutils.BuildAuthToken(endpoint, p.rdsRegion, user, awsSess.Config.Credentials)
+}
+
+// checkRole verifies the caller either is the configured role or is allowed to assume it
+func (p *IAMAuth) checkRole(client *sts.STS, callerArn string, sessionID string) (bool, error) {
+	caller, err := arn.Parse(callerArn)
 	if err != nil {
 		return false, err
 	}
-	authResp, ok := srvMsg.(*pgproto.AuthenticationRequest)
-	if !ok {
-		return false, fmt.Errorf("unexpected response type from server request")
+	role, err := arn.Parse(p.roleArn)
+	if err != nil {
+		return false, err
+	}
+
+	// arn:aws:sts::<account>:assumed-role/<role name>/<session name>
+	if caller.Service == "sts" && caller.AccountID == role.AccountID && strings.HasPrefix(caller.Resource, "assumed-role/") {
+		parts := strings.Split(caller.Resource, "/")
+		if len(parts) == 3 && parts[1] == roleName(role) {
+			return true, nil
+		}
+	}
+
+	_, err = client.AssumeRole(&sts.AssumeRoleInput{
+		RoleArn:         aws.String(p.roleArn),
+		RoleSessionName: aws.String("pggateway-" + sessionID),
+		DurationSeconds: aws.Int64(900),
+	})
+	return err == nil, nil
+}
+
+// databaseCredentials returns the target server credentials for the caller from the first matching rule
+func (p *IAMAuth) databaseCredentials(callerArn string) (string, string, bool, error) {
+	var tags map[string]string
+	for _, r := range p.rules {
+		if !r.principal.MatchString(callerArn) {
+			continue
+		}
+
+		if len(r.tags) > 0 && tags == nil {
+			var err error
+			tags, err = p.principalTags(callerArn)
+			if err != nil {
+				return "", "", false, err
+			}
+		}
+
+		matched := true
+		for k, v := range r.tags {
+			if tags[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return r.user, r.password, true, nil
+		}
+	}
+
+	if p.dbUser == "" {
+		return "", "", false, nil
 	}
-	if authResp.Method == pgproto.AuthenticationMethodOK {
-		return true, sess.WriteToClient(authResp)
+	return p.dbUser, p.dbPassword, true, nil
+}
+
+// principalTags looks up the tags of the calling IAM user or role using the gateway's own credentials
+func (p *IAMAuth) principalTags(callerArn string) (map[string]string, error) {
+	caller, err := arn.Parse(callerArn)
+	if err != nil {
+		return nil, err
+	}
+
+	awsSess, err := session.NewSession(&aws.Config{Region: aws.String(p.region), Credentials: p.credentials})
+	if err != nil {
+		return nil, err
 	}
+	client := iam.New(awsSess, p.serviceConfig(p.iamEndpoint))
 
-	passwdReq := &pgproto.PasswordMessage{}
-	switch authResp.Method {
-	case pgproto.AuthenticationMethodPlaintext:
-		passwdReq.Password = []byte(p.dbPassword)
-	case pgproto.AuthenticationMethodMD5:
-		passwdReq.SetPassword([]byte(p.dbUser), []byte(p.dbPassword), authResp.Salt)
-	default:
-		return false, fmt.Errorf("unexpected password request method from server")
+	parts := strings.Split(caller.Resource, "/")
+	switch {
+	case caller.Service == "iam" && parts[0] == "user":
+		return listTags(client, opListUserTags, &listUserTagsInput{UserName: aws.String(parts[len(parts)-1])})
+	case caller.Service == "sts" && parts[0] == "assumed-role" && len(parts) == 3:
+		return listTags(client, opListRoleTags, &listRoleTagsInput{RoleName: aws.String(parts[1])})
 	}
+	return map[string]string{}, nil
+}
+
+func (p *IAMAuth) serviceConfig(endpoint string) *aws.Config {
+	config := aws.NewConfig()
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+	return config
+}
 
-	return true, sess.WriteToServer(passwdReq)
+// roleName returns the role name from a role ARN, `role/<path>/<name>`
+func roleName(role arn.ARN) string {
+	parts := strings.Split(role.Resource, "/")
+	return parts[len(parts)-1]
 }
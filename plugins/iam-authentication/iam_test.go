@@ -0,0 +1,297 @@
+package iam
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pggatewaytest"
+)
+
+const testRole = "arn:aws:iam::123456789012:role/database-access"
+
+type testPrincipal struct {
+	secret     string
+	token      string
+	arn        string
+	assumeRole bool
+	tags       map[string]string
+}
+
+// testAWS stands in for the STS and IAM query APIs and checks every request is signed by a known principal
+type testAWS struct {
+	t          *testing.T
+	principals map[string]testPrincipal
+
+	// AssumeRole requests, each creates a role session
+	mutex   *sync.Mutex
+	assumed []url.Values
+}
+
+func (a *testAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	principal, ok := a.verify(r, body)
+	if !ok {
+		a.error(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+
+	form, _ := url.ParseQuery(string(body))
+	action := form.Get("Action")
+	switch action {
+	case "GetCallerIdentity":
+		fmt.Fprintf(w, "<%sResponse><%sResult><Arn>%s</Arn><Account>123456789012</Account><UserId>ID</UserId></%sResult></%sResponse>",
+			action, action, principal.arn, action, action)
+	case "AssumeRole":
+		a.mutex.Lock()
+		a.assumed = append(a.assumed, form)
+		a.mutex.Unlock()
+		if !principal.assumeRole || form.Get("RoleArn") != testRole {
+			a.error(w, http.StatusForbidden, "AccessDenied", "not authorized to perform sts:AssumeRole")
+			return
+		}
+		fmt.Fprintf(w, "<%sResponse><%sResult><Credentials><AccessKeyId>ASIATEMP</AccessKeyId><SecretAccessKey>temp</SecretAccessKey>"+
+			"<SessionToken>temp</SessionToken><Expiration>%s</Expiration></Credentials></%sResult></%sResponse>",
+			action, action, time.Now().Add(15*time.Minute).UTC().Format(time.RFC3339), action, action)
+	case "ListUserTags", "ListRoleTags":
+		var tags []testPrincipal
+		for _, p := range a.principals {
+			parts := strings.Split(p.arn, "/")
+			if parts[len(parts)-1] == form.Get("UserName") || (len(parts) == 3 && parts[1] == form.Get("RoleName")) {
+				tags = append(tags, p)
+			}
+		}
+		fmt.Fprintf(w, "<%sResponse><%sResult><Tags>", action, action)
+		for _, p := range tags {
+			for k, v := range p.tags {
+				fmt.Fprintf(w, "<member><Key>%s</Key><Value>%s</Value></member>", k, v)
+			}
+		}
+		fmt.Fprintf(w, "</Tags><IsTruncated>false</IsTruncated></%sResult></%sResponse>", action, action)
+	default:
+		a.error(w, http.StatusBadRequest, "InvalidAction", action)
+	}
+}
+
+// verify recomputes the request's signature with the secret of the access key it claims to be from
+func (a *testAWS) verify(r *http.Request, body []byte) (testPrincipal, bool) {
+	authorization := r.Header.Get("Authorization")
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ", ") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	// <access key>/<date>/<region>/<service>/aws4_request
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 {
+		return testPrincipal{}, false
+	}
+	principal, ok := a.principals[scope[0]]
+	if !ok || r.Header.Get("X-Amz-Security-Token") != principal.token {
+		return testPrincipal{}, false
+	}
+	signTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return testPrincipal{}, false
+	}
+
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		if name != "host" {
+			req.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials(scope[0], principal.secret, principal.token))
+	_, err = signer.Sign(req, bytes.NewReader(body), scope[3], scope[2], signTime)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return principal, req.Header.Get("Authorization") == authorization
+}
+
+func (a *testAWS) error(w http.ResponseWriter, status int, code string, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>1</RequestId></ErrorResponse>", code, message)
+}
+
+func (a *testAWS) assumedRoles() []url.Values {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	assumed := a.assumed
+	a.assumed = nil
+	return assumed
+}
+
+func TestIAMAuthenticate(t *testing.T) {
+	api := &testAWS{
+		t:     t,
+		mutex: &sync.Mutex{},
+		principals: map[string]testPrincipal{
+			"AKIDGATEWAY": {secret: "gateway-secret", arn: "arn:aws:iam::123456789012:user/pggateway"},
+			"AKIDALICE": {
+				secret:     "alice-secret",
+				arn:        "arn:aws:iam::123456789012:user/alice",
+				assumeRole: true,
+				tags:       map[string]string{"team": "analytics"},
+			},
+			"AKIDCAROL": {secret: "carol-secret", arn: "arn:aws:iam::123456789012:user/carol"},
+			"ASIABOB": {
+				secret: "bob-secret",
+				token:  "bob-token",
+				arn:    "arn:aws:sts::123456789012:assumed-role/database-access/bob",
+			},
+		},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	target := pggatewaytest.NewTarget(t)
+	defer target.Close()
+
+	plugin, err := newIAMPlugin(pggateway.ConfigMap{
+		"role":      testRole,
+		"endpoints": map[interface{}]interface{}{"sts": server.URL, "iam": server.URL},
+		"rules": []interface{}{
+			map[interface{}]interface{}{
+				"principal": "arn:aws:iam::123456789012:user/*",
+				"tags":      map[interface{}]interface{}{"team": "analytics"},
+				"user":      "analyst",
+			},
+		},
+		"db": map[interface{}]interface{}{"user": "readonly"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := plugin.(*IAMAuth)
+	auth.credentials = credentials.NewStaticCredentials("AKIDGATEWAY", "gateway-secret", "")
+
+	for _, test := range []struct {
+		accessKey string
+		password  string
+		user      string
+		allowed   bool
+		// Whether the role is assumed to check the caller may assume it
+		assumed bool
+	}{
+		// Can assume the role and has the rule's tags
+		{"AKIDALICE", "alice-secret", "analyst", true, true},
+		{"AKIDALICE", "wrong-secret", "", false, false},
+		// Valid credentials, but cannot assume the role
+		{"AKIDCAROL", "carol-secret", "", false, true},
+		// Temporary credentials of the role itself fall back to `db`, without assuming the role again
+		{"ASIABOB", "bob-secret:bob-token", "readonly", true, false},
+		{"ASIABOB", "bob-secret", "", false, false},
+		{"AKIDUNKNOWN", "secret", "", false, false},
+	} {
+		sess, startup := pggatewaytest.NewSession(t, target, map[string]string{"user": test.accessKey, "database": "app"}, test.password)
+		allowed, err := auth.Authenticate(sess, startup)
+		sess.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.accessKey, err)
+			continue
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s with %#v: expected allowed %v, got %v", test.accessKey, test.password, test.allowed, allowed)
+			continue
+		}
+
+		if test.allowed {
+			select {
+			case options := <-target.Startups:
+				if options["user"] != test.user || options["database"] != "app" {
+					t.Errorf("%s: expected a login as %#v, got %#v", test.accessKey, test.user, options)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: expected a login to the target server", test.accessKey)
+			}
+		}
+
+		// The probe really assumes the role, leaving a short role session named after the gateway session in the caller's account
+		assumed := api.assumedRoles()
+		if !test.assumed {
+			if len(assumed) != 0 {
+				t.Errorf("%s: expected the role not to be assumed, got %#v", test.accessKey, assumed)
+			}
+			continue
+		}
+		if len(assumed) != 1 {
+			t.Errorf("%s: expected the role to be assumed once, got %#v", test.accessKey, assumed)
+			continue
+		}
+		if assumed[0].Get("RoleArn") != testRole || assumed[0].Get("RoleSessionName") != "pggateway-"+sess.ID || assumed[0].Get("DurationSeconds") != "900" {
+			t.Errorf("%s: unexpected AssumeRole request %#v", test.accessKey, assumed[0])
+		}
+	}
+}
+
+func TestIAMRejectsDBSSL(t *testing.T) {
+	_, err := newIAMPlugin(pggateway.ConfigMap{
+		"role": testRole,
+		"db":   map[interface{}]interface{}{"user": "readonly", "ssl": false},
+	})
+	if err == nil {
+		t.Fatal("expected the removed 'db.ssl' option to be rejected")
+	}
+}
+
+func TestRDSAuthToken(t *testing.T) {
+	plugin, err := newIAMPlugin(pggateway.ConfigMap{
+		"role":    testRole,
+		"rds_iam": map[interface{}]interface{}{"region": "eu-west-1"},
+		"db":      map[interface{}]interface{}{"user": "app"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := plugin.(*IAMAuth)
+	auth.credentials = credentials.NewStaticCredentials("AKIDGATEWAY", "gateway-secret", "")
+
+	token, err := auth.rdsAuthToken("mydb.example.eu-west-1.rds.amazonaws.com:5432", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is a presigned `connect` URL without its scheme
+	u, err := url.Parse("https://" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Host != "mydb.example.eu-west-1.rds.amazonaws.com:5432" || query.Get("Action") != "connect" || query.Get("DBUser") != "app" {
+		t.Fatalf("unexpected token %#v", token)
+	}
+	if !strings.HasPrefix(query.Get("X-Amz-Credential"), "AKIDGATEWAY/") || !strings.HasSuffix(query.Get("X-Amz-Credential"), "/eu-west-1/rds-db/aws4_request") {
+		t.Fatalf("unexpected credential scope %#v", query.Get("X-Amz-Credential"))
+	}
+
+	// Presigning the same request at the same time with the gateway's secret gives the same signature
+	signTime, err := time.Parse("20060102T150405Z", query.Get("X-Amz-Date"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://"+u.Host+"/", nil)
+	req.URL.RawQuery = url.Values{"Action": {"connect"}, "DBUser": {"app"}}.Encode()
+	signer := v4.NewSigner(credentials.NewStaticCredentials("AKIDGATEWAY", "gateway-secret", ""))
+	_, err = signer.Presign(req, nil, "rds-db", "eu-west-1", 15*time.Minute, signTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query.Get("X-Amz-Signature") == "" || req.URL.Query().Get("X-Amz-Signature") != query.Get("X-Amz-Signature") {
+		t.Fatalf("token signature %#v does not verify", query.Get("X-Amz-Signature"))
+	}
+}
@@ -0,0 +1,59 @@
+package iam
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// The vendored aws-sdk-go predates IAM tagging, these shapes let us call the tag APIs with the IAM client
+
+const (
+	opListUserTags = "ListUserTags"
+	opListRoleTags = "ListRoleTags"
+)
+
+type listUserTagsInput struct {
+	_ struct{} `type:"structure"`
+
+	UserName *string `min:"1" type:"string" required:"true"`
+}
+
+type listRoleTagsInput struct {
+	_ struct{} `type:"structure"`
+
+	RoleName *string `min:"1" type:"string" required:"true"`
+}
+
+type listTagsOutput struct {
+	_ struct{} `type:"structure"`
+
+	Tags []*tag `type:"list" required:"true"`
+}
+
+type tag struct {
+	_ struct{} `type:"structure"`
+
+	Key   *string `min:"1" type:"string" required:"true"`
+	Value *string `type:"string" required:"true"`
+}
+
+func listTags(client *iam.IAM, operation string, input interface{}) (map[string]string, error) {
+	output := &listTagsOutput{}
+	req := client.NewRequest(&request.Operation{
+		Name:       operation,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, input, output)
+
+	err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, t := range output.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
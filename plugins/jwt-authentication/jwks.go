@@ -0,0 +1,209 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum time between JWKS refreshes triggered by an unknown key id
+const minRefreshInterval = time.Minute
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type keySet struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+
+	// Guards keys and fetchedAt, never held while loading
+	lock      *sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// Held while loading, so concurrent logins needing a refresh load the key set once
+	loading *sync.Mutex
+}
+
+// errUnsupportedKey is returned for keys of a type or curve which cannot sign tokens the plugin accepts
+var errUnsupportedKey = fmt.Errorf("unsupported key")
+
+func newKeySet(source string, refresh time.Duration) (*keySet, error) {
+	ks := &keySet{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		lock:    &sync.Mutex{},
+		loading: &sync.Mutex{},
+	}
+
+	err := ks.load()
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// key returns the public key for the key id, refreshing the key set when it is stale or the key is unknown
+func (ks *keySet) key(kid string) (crypto.PublicKey, error) {
+	key, ok, fetchedAt := ks.lookup(kid)
+	age := time.Since(fetchedAt)
+	if (ok && age > ks.refresh) || (!ok && age > minRefreshInterval) {
+		err := ks.refreshSince(fetchedAt)
+		if err != nil && !ok {
+			return nil, err
+		}
+		if err == nil {
+			key, ok, _ = ks.lookup(kid)
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %#v", kid)
+	}
+	return key, nil
+}
+
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool, time.Time) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	key, ok := ks.keys[kid]
+	return key, ok, ks.fetchedAt
+}
+
+// refreshSince loads the key set unless another login has loaded it since fetchedAt
+func (ks *keySet) refreshSince(fetchedAt time.Time) error {
+	ks.loading.Lock()
+	defer ks.loading.Unlock()
+
+	ks.lock.Lock()
+	refreshed := ks.fetchedAt.After(fetchedAt)
+	ks.lock.Unlock()
+	if refreshed {
+		return nil
+	}
+	return ks.load()
+}
+
+// load reads the key set and replaces the current keys, keys which are not supported are skipped
+func (ks *keySet) load() error {
+	var data []byte
+	var err error
+	if strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://") {
+		data, err = ks.fetch()
+	} else {
+		data, err = ioutil.ReadFile(ks.source)
+	}
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return fmt.Errorf("error parsing JWKS: %s", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err == errUnsupportedKey {
+			// e.g. OKP or symmetric keys published alongside the signing keys
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing JWK %#v: %s", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	return nil
+}
+
+func (ks *keySet) fetch() ([]byte, error) {
+	resp, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching JWKS: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid EC public key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errUnsupportedKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
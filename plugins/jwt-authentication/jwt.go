@@ -0,0 +1,279 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+type JWTAuth struct {
+	keys       *keySet
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	claim      string
+	users      map[string]string
+	dbPassword string
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Curves of the keys ECDSA algorithms must be used with
+var algorithmCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("jwt", newJWTPlugin)
+}
+
+func newJWTPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	var ok bool
+	auth := &JWTAuth{
+		users: make(map[string]string),
+	}
+
+	jwks, ok := config.String("jwks")
+	if !ok {
+		return nil, fmt.Errorf("'jwks' configuration value is required")
+	}
+
+	auth.issuer, ok = config.String("issuer")
+	if !ok {
+		return nil, fmt.Errorf("'issuer' configuration value is required")
+	}
+
+	auth.audience, ok = config.String("audience")
+	if !ok {
+		return nil, fmt.Errorf("'audience' configuration value is required")
+	}
+
+	auth.leeway = config.DurationDefault("leeway", time.Minute)
+	auth.claim = config.StringDefault("claim", "sub")
+
+	users, _ := config.Map("users")
+	for value := range users {
+		user, ok := users.String(value)
+		if !ok {
+			return nil, fmt.Errorf("'users.%s' must be a string", value)
+		}
+		auth.users[value] = user
+	}
+
+	db, _ := config.Map("db")
+	auth.dbPassword = db.StringDefault("password", "")
+
+	var err error
+	auth.keys, err = newKeySet(jwks, config.DurationDefault("jwks_refresh", time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	return auth, nil
+}
+
+func (p *JWTAuth) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
+func (p *JWTAuth) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	// Bearer tokens are sent as plaintext passwords
+	if !sess.IsSSL {
+		return false, fmt.Errorf("JWT auth requires an SSL session")
+	}
+
+	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
+	if err != nil {
+		return false, err
+	}
+
+	claims, err := p.verify(string(passwd.Password))
+	if err != nil {
+		sess.LogInfo("JWT rejected: %s", err)
+		return false, nil
+	}
+
+	user, ok := p.databaseUser(claims)
+	if !ok {
+		sess.LogInfo("JWT claim %#v does not map to a database user", p.claim)
+		return false, nil
+	}
+
+	err = sess.LoginToServer(startup, []byte(user), []byte(p.dbPassword))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// databaseUser maps the configured claim to a database user, the claim may be a string or a list of strings
+func (p *JWTAuth) databaseUser(claims map[string]interface{}) (string, bool) {
+	var values []string
+	switch v := claims[p.claim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	for _, v := range values {
+		if len(p.users) == 0 {
+			return v, v != ""
+		}
+		if user, ok := p.users[v]; ok {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// verify checks the token signature and registered claims and returns the token's claims
+func (p *JWTAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var h header
+	err := decodeSegment(parts[0], &h)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+
+	hash, ok := algorithms[h.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %#v", h.Alg)
+	}
+
+	key, err := p.keys.key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %s", err)
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	digest := hasher.Sum(nil)
+
+	err = verifySignature(h.Alg, key, hash, digest, sig)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(p.leeway)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(p.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.issuer {
+		return nil, fmt.Errorf("unexpected token issuer %#v", iss)
+	}
+
+	audOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOK = aud == p.audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == p.audience {
+				audOK = true
+				break
+			}
+		}
+	}
+	if !audOK {
+		return nil, fmt.Errorf("token audience does not match")
+	}
+
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest []byte, sig []byte) error {
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signing key type does not match algorithm %#v", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signing key type does not match algorithm %#v", alg)
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().Name != algorithmCurves[alg] {
+			return fmt.Errorf("signing key type does not match algorithm %#v", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signing algorithm %#v", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,132 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": key.Curve.Params().Name,
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+func signES(t *testing.T, alg string, kid string, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hasher := algorithms[alg].New()
+	hasher.Write([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hasher.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWKSSkipsUnsupportedKeys(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	set := map[string]interface{}{
+		"keys": []interface{}{
+			map[string]string{"kid": "ed", "kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"},
+			map[string]string{"kid": "hmac", "kty": "oct", "k": "c2VjcmV0"},
+			ecJWK("p256", p256),
+			ecJWK("p384", p384),
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer server.Close()
+
+	plugin, err := newJWTPlugin(pggateway.ConfigMap{
+		"jwks":     server.URL,
+		"issuer":   "https://issuer.example",
+		"audience": "pggateway",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := plugin.(*JWTAuth)
+
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example",
+		"aud": "pggateway",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for _, test := range []struct {
+		alg   string
+		kid   string
+		key   *ecdsa.PrivateKey
+		valid bool
+	}{
+		{"ES256", "p256", p256, true},
+		{"ES384", "p384", p384, true},
+		// The algorithm must match the curve of the key
+		{"ES384", "p256", p256, false},
+		{"ES256", "p384", p384, false},
+	} {
+		_, err := auth.verify(signES(t, test.alg, test.kid, test.key, claims))
+		if (err == nil) != test.valid {
+			t.Errorf("%s with key %s: expected valid %v, got error %v", test.alg, test.kid, test.valid, err)
+		}
+	}
+}
+
+func TestJWKSFetchDoesNotBlockKnownKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	block := make(chan struct{})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			<-block
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{ecJWK("known", key)}})
+	}))
+	defer server.Close()
+	defer close(block)
+
+	ks, err := newKeySet(server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the set old enough for an unknown key id to trigger a refresh, which hangs
+	ks.fetchedAt = ks.fetchedAt.Add(-2 * minRefreshInterval)
+	go ks.key("unknown")
+	time.Sleep(50 * time.Millisecond)
+
+	found := make(chan crypto.PublicKey)
+	go func() {
+		k, _ := ks.key("known")
+		found <- k
+	}()
+	select {
+	case k := <-found:
+		if k == nil {
+			t.Fatal("expected the known key")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup of a known key blocked on a JWKS fetch")
+	}
+}
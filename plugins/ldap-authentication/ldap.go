@@ -0,0 +1,231 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type LDAPAuth struct {
+	url       string
+	startTLS  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	// Simple bind
+	bindDN string
+
+	// Search and bind
+	baseDN         string
+	searchFilter   string
+	searchBindDN   string
+	searchPassword string
+
+	// Group membership
+	groupDN     string
+	groupFilter string
+
+	dbUser     string
+	dbPassword string
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("ldap", newLDAPPlugin)
+}
+
+func newLDAPPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	var ok bool
+	auth := &LDAPAuth{}
+
+	auth.url, ok = config.String("url")
+	if !ok {
+		return nil, fmt.Errorf("'url' configuration value is required")
+	}
+	u, err := url.Parse(auth.url)
+	if err != nil {
+		return nil, fmt.Errorf("'url' is invalid: %s", err)
+	}
+
+	auth.startTLS = config.BoolDefault("start_tls", false)
+	auth.timeout = config.DurationDefault("timeout", 10*time.Second)
+	auth.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	if ca, ok := config.String("ca"); ok {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		auth.tlsConfig.RootCAs = x509.NewCertPool()
+		if !auth.tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %#v", ca)
+		}
+	}
+
+	auth.bindDN = config.StringDefault("bind_dn", "")
+	auth.baseDN = config.StringDefault("base_dn", "")
+	switch {
+	case auth.bindDN != "" && auth.baseDN != "":
+		return nil, fmt.Errorf("only one of 'bind_dn' or 'base_dn' can be configured")
+	case auth.bindDN != "":
+		if !strings.Contains(auth.bindDN, "%s") {
+			return nil, fmt.Errorf("'bind_dn' must contain a '%%s' placeholder for the user name")
+		}
+	case auth.baseDN != "":
+		auth.searchFilter = config.StringDefault("search_filter", "(uid=%s)")
+		auth.searchBindDN = config.StringDefault("search_bind_dn", "")
+		auth.searchPassword = config.StringDefault("search_bind_password", "")
+	default:
+		return nil, fmt.Errorf("one of 'bind_dn' or 'base_dn' configuration values is required")
+	}
+
+	auth.groupDN = config.StringDefault("group_dn", "")
+	auth.groupFilter = config.StringDefault("group_filter", "(|(member=%s)(uniqueMember=%s))")
+
+	db, ok := config.Map("db")
+	if !ok {
+		return nil, fmt.Errorf("'db' configuration value is required")
+	}
+	auth.dbUser = db.StringDefault("user", "")
+	auth.dbPassword = db.StringDefault("password", "")
+
+	return auth, nil
+}
+
+func (p *LDAPAuth) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
+func (p *LDAPAuth) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	if !sess.IsSSL {
+		return false, fmt.Errorf("LDAP auth requires an SSL session")
+	}
+
+	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
+	if err != nil {
+		return false, err
+	}
+
+	// An empty password would be treated as an anonymous bind by the directory
+	if len(passwd.Password) == 0 {
+		return false, nil
+	}
+
+	success, err := p.bind(string(sess.User), string(passwd.Password))
+	if err != nil || !success {
+		return false, err
+	}
+
+	user := p.dbUser
+	if user == "" {
+		user = string(sess.User)
+	}
+	err = sess.LoginToServer(startup, []byte(user), []byte(p.dbPassword))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// bind checks the user's password against the directory and their group membership when configured
+func (p *LDAPAuth) bind(user string, password string) (bool, error) {
+	conn, err := ldap.DialURL(p.url, ldap.DialWithDialer(&net.Dialer{Timeout: p.timeout}), ldap.DialWithTLSConfig(p.tlsConfig))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(p.timeout)
+
+	if p.startTLS {
+		err = conn.StartTLS(p.tlsConfig)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var userDN string
+	if p.bindDN != "" {
+		userDN = strings.Replace(p.bindDN, "%s", escapeDN(user), -1)
+	} else {
+		userDN, err = p.search(conn, user)
+		if err != nil || userDN == "" {
+			return false, err
+		}
+	}
+
+	err = conn.Bind(userDN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if p.groupDN == "" {
+		return true, nil
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.groupDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(p.timeout.Seconds()), false,
+		strings.Replace(p.groupFilter, "%s", ldap.EscapeFilter(userDN), -1),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return false, err
+	}
+	return len(res.Entries) > 0, nil
+}
+
+// search finds the DN of the user, an empty DN is returned when there is no single matching entry
+func (p *LDAPAuth) search(conn *ldap.Conn, user string) (string, error) {
+	var err error
+	if p.searchBindDN != "" {
+		err = conn.Bind(p.searchBindDN, p.searchPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(p.timeout.Seconds()), false,
+		strings.Replace(p.searchFilter, "%s", ldap.EscapeFilter(user), -1),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return "", err
+	}
+	if len(res.Entries) != 1 {
+		return "", nil
+	}
+	return res.Entries[0].DN, nil
+}
+
+// escapeDN escapes a value for use as an attribute value in a DN (RFC 4514)
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '#' && i == 0, c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package ldap
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pggatewaytest"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testDirectory stands in for an LDAP server, answering simple binds and searches
+type testDirectory struct {
+	listener net.Listener
+	// Passwords by DN, anonymous binds are allowed
+	passwords map[string]string
+	// DNs of the entries searches with a filter find
+	entries map[string][]string
+
+	mutex   *sync.Mutex
+	binds   []string
+	filters []string
+}
+
+func newTestDirectory(t *testing.T, passwords map[string]string, entries map[string][]string) *testDirectory {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{listener: l, passwords: passwords, entries: entries, mutex: &sync.Mutex{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, password := op.Children[1].Data.String(), op.Children[2].Data.String()
+			d.mutex.Lock()
+			d.binds = append(d.binds, dn)
+			d.mutex.Unlock()
+			code := ldap.LDAPResultInvalidCredentials
+			if (dn == "" && password == "") || (password != "" && d.passwords[dn] == password) {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+			d.mutex.Lock()
+			d.filters = append(d.filters, filter)
+			d.mutex.Unlock()
+			for _, dn := range d.entries[filter] {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "searchResEntry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "objectName"))
+				entry.AppendChild(ber.NewSequence("attributes"))
+				conn.Write(ldapMessage(id, entry).Bytes())
+			}
+			conn.Write(ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+// recorded returns the DNs bound as and the search filters received since it was last called
+func (d *testDirectory) recorded() ([]string, []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	binds, filters := d.binds, d.filters
+	d.binds, d.filters = nil, nil
+	return binds, filters
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.NewSequence("LDAP Message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "messageID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResult(id int64, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "LDAPResult")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return ldapMessage(id, op)
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	directory := newTestDirectory(t,
+		map[string]string{
+			"uid=alice,ou=people,dc=example,dc=com":           "alice-secret",
+			`uid=bob\,ou\=admins,ou=people,dc=example,dc=com`: "bob-secret",
+			"uid=carol,ou=people,dc=example,dc=com":           "carol-secret",
+			"cn=search,dc=example,dc=com":                     "search-secret",
+		},
+		map[string][]string{
+			"(uid=alice)": {"uid=alice,ou=people,dc=example,dc=com"},
+			"(uid=carol)": {"uid=carol,ou=people,dc=example,dc=com"},
+			"(|(member=uid=alice,ou=people,dc=example,dc=com)(uniqueMember=uid=alice,ou=people,dc=example,dc=com))": {"cn=db,ou=groups,dc=example,dc=com"},
+		},
+	)
+	defer directory.listener.Close()
+	target := pggatewaytest.NewTarget(t)
+	defer target.Close()
+
+	simple, err := newLDAPPlugin(pggateway.ConfigMap{
+		"url":     "ldap://" + directory.listener.Addr().String(),
+		"bind_dn": "uid=%s,ou=people,dc=example,dc=com",
+		"db":      map[interface{}]interface{}{"user": "app"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search, err := newLDAPPlugin(pggateway.ConfigMap{
+		"url":                  "ldap://" + directory.listener.Addr().String(),
+		"base_dn":              "ou=people,dc=example,dc=com",
+		"search_bind_dn":       "cn=search,dc=example,dc=com",
+		"search_bind_password": "search-secret",
+		"group_dn":             "cn=db,ou=groups,dc=example,dc=com",
+		"db":                   map[interface{}]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		plugin   pggateway.AuthenticationPlugin
+		user     string
+		password string
+		success  bool
+		// Target server user logged in as on success
+		targetUser string
+		binds      []string
+		filters    []string
+	}{
+		{
+			name: "bind", plugin: simple, user: "alice", password: "alice-secret", success: true, targetUser: "app",
+			binds: []string{"uid=alice,ou=people,dc=example,dc=com"},
+		},
+		{
+			name: "wrong password", plugin: simple, user: "alice", password: "wrong",
+			binds: []string{"uid=alice,ou=people,dc=example,dc=com"},
+		},
+		{
+			name: "escaped DN", plugin: simple, user: "bob,ou=admins", password: "bob-secret", success: true, targetUser: "app",
+			binds: []string{`uid=bob\,ou\=admins,ou=people,dc=example,dc=com`},
+		},
+		// Would be an anonymous bind, which directories accept
+		{name: "empty password", plugin: simple, user: "alice", password: ""},
+		{
+			name: "search and bind", plugin: search, user: "alice", password: "alice-secret", success: true, targetUser: "alice",
+			binds: []string{"cn=search,dc=example,dc=com", "uid=alice,ou=people,dc=example,dc=com"},
+			filters: []string{
+				"(uid=alice)",
+				"(|(member=uid=alice,ou=people,dc=example,dc=com)(uniqueMember=uid=alice,ou=people,dc=example,dc=com))",
+			},
+		},
+		{
+			name: "not in group", plugin: search, user: "carol", password: "carol-secret",
+			binds: []string{"cn=search,dc=example,dc=com", "uid=carol,ou=people,dc=example,dc=com"},
+			filters: []string{
+				"(uid=carol)",
+				"(|(member=uid=carol,ou=people,dc=example,dc=com)(uniqueMember=uid=carol,ou=people,dc=example,dc=com))",
+			},
+		},
+		// Filter syntax in the user name is matched literally
+		{
+			name: "escaped filter", plugin: search, user: "*)(uid=*", password: "alice-secret",
+			binds:   []string{"cn=search,dc=example,dc=com"},
+			filters: []string{`(uid=\2a\29\28uid=\2a)`},
+		},
+	} {
+		sess, startup := pggatewaytest.NewSession(t, target, map[string]string{"user": test.user, "database": "app"}, test.password)
+		success, err := test.plugin.Authenticate(sess, startup)
+		sess.Close()
+		binds, filters := directory.recorded()
+		if err != nil || success != test.success {
+			t.Errorf("%s: expected success %v, got %v with error %v", test.name, test.success, success, err)
+			continue
+		}
+		if !reflect.DeepEqual(binds, test.binds) || !reflect.DeepEqual(filters, test.filters) {
+			t.Errorf("%s: expected binds %#v and searches %#v, got %#v and %#v", test.name, test.binds, test.filters, binds, filters)
+		}
+
+		if test.success {
+			select {
+			case options := <-target.Startups:
+				if options["user"] != test.targetUser {
+					t.Errorf("%s: expected a login as %#v, got %#v", test.name, test.targetUser, options)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: expected a login to the target server", test.name)
+			}
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for value, expected := range map[string]string{
+		"alice":         "alice",
+		"bob,ou=admins": `bob\,ou\=admins`,
+		`a+b"c\d<e>f;g`: `a\+b\"c\\d\<e\>f\;g`,
+		"#hash":         `\#hash`,
+		"a#b":           "a#b",
+		" padded ":      `\ padded\ `,
+		"nul\x00":       `nul\00`,
+	} {
+		if escaped := escapeDN(value); escaped != expected {
+			t.Errorf("%#v: expected %#v, got %#v", value, expected, escaped)
+		}
+	}
+}
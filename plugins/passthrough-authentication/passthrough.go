@@ -16,6 +16,12 @@ func newPassthroughPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationP
 	return &Passthrough{}, nil
 }
 
+func (p *Passthrough) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
 func (p *Passthrough) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	// The target server authenticates the client
+	sess.SetAuthMethod("passthrough")
 	return true, sess.WriteToServer(startup)
 }
@@ -0,0 +1,271 @@
+package userlist
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type account struct {
+	user     string
+	password string
+}
+
+type entry struct {
+	password string
+	scram    *pggateway.SCRAMVerifier
+	account  string
+}
+
+type UserList struct {
+	filename string
+	db       account
+	accounts map[string]account
+
+	lock    *sync.RWMutex
+	users   map[string]entry
+	modTime time.Time
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("userlist", newUserListPlugin)
+}
+
+func newUserListPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	var ok bool
+	auth := &UserList{
+		accounts: make(map[string]account),
+		lock:     &sync.RWMutex{},
+	}
+
+	auth.filename, ok = config.String("file")
+	if !ok {
+		return nil, fmt.Errorf("'file' configuration value is required")
+	}
+
+	db, ok := config.Map("db")
+	if !ok {
+		return nil, fmt.Errorf("'db' configuration value is required")
+	}
+	auth.db.user, ok = db.String("user")
+	if !ok {
+		return nil, fmt.Errorf("'db.user' configuration value is required")
+	}
+	auth.db.password = db.StringDefault("password", "")
+
+	accounts, _ := config.Map("accounts")
+	for name := range accounts {
+		acct, ok := accounts.Map(name)
+		if !ok {
+			return nil, fmt.Errorf("'accounts.%s' must be a map", name)
+		}
+		user, ok := acct.String("user")
+		if !ok {
+			return nil, fmt.Errorf("'accounts.%s.user' configuration value is required", name)
+		}
+		auth.accounts[name] = account{
+			user:     user,
+			password: acct.StringDefault("password", ""),
+		}
+	}
+
+	changed, err := auth.reload()
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return nil, fmt.Errorf("could not load user list %#v", auth.filename)
+	}
+
+	return auth, nil
+}
+
+func (p *UserList) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
+func (p *UserList) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	_, err := p.reload()
+	if err != nil {
+		// Keep using the last good user list
+		sess.LogWarn("error reloading user list %#v: %s", p.filename, err)
+	}
+
+	p.lock.RLock()
+	e, ok := p.users[string(sess.User)]
+	p.lock.RUnlock()
+
+	var success bool
+	switch {
+	case !ok:
+		// Run a SCRAM exchange which always fails so unknown users look like bad passwords
+		success, err = sess.VerifySCRAM(nil)
+	case e.scram != nil:
+		success, err = sess.VerifySCRAM(e.scram)
+	case strings.HasPrefix(e.password, "md5"):
+		success, err = p.verifyMD5(sess, e.password)
+	default:
+		success, err = p.verifyBcrypt(sess, e.password)
+	}
+	if err != nil || !success {
+		return false, err
+	}
+
+	acct := p.db
+	if e.account != "" {
+		acct = p.accounts[e.account]
+	}
+
+	err = sess.LoginToServer(startup, []byte(acct.user), []byte(acct.password))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *UserList) verifyMD5(sess *pggateway.Session, stored string) (bool, error) {
+	auth, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodMD5)
+	if err != nil {
+		return false, err
+	}
+
+	// The client sends "md5" + md5(md5(password + user) + salt), we store "md5" + md5(password + user)
+	sum := md5.Sum(append([]byte(stored[3:]), auth.Salt...))
+	expected := "md5" + hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), passwd.Password) == 1, nil
+}
+
+func (p *UserList) verifyBcrypt(sess *pggateway.Session, stored string) (bool, error) {
+	// bcrypt needs the plaintext password from the client
+	if !sess.IsSSL {
+		return false, fmt.Errorf("userlist bcrypt passwords require an SSL session")
+	}
+
+	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
+	if err != nil {
+		return false, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(stored), passwd.Password)
+	return err == nil, nil
+}
+
+// reload parses the user list file if it has changed since it was last loaded
+func (p *UserList) reload() (bool, error) {
+	info, err := os.Stat(p.filename)
+	if err != nil {
+		return false, err
+	}
+
+	p.lock.RLock()
+	modTime := p.modTime
+	p.lock.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	users, err := p.parseUserList(f)
+	if err != nil {
+		return false, err
+	}
+
+	p.lock.Lock()
+	p.users = users
+	p.modTime = info.ModTime()
+	p.lock.Unlock()
+	return true, nil
+}
+
+// parseUserList parses lines of `"user" "password" ["account"]`, a literal `"` is written as `""`
+func (p *UserList) parseUserList(r io.Reader) (map[string]entry, error) {
+	users := make(map[string]entry)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		fields, err := splitQuoted(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected \"user\" \"password\" [\"account\"]", lineNum)
+		}
+
+		e := entry{password: fields[1]}
+		switch {
+		case strings.HasPrefix(e.password, "SCRAM-SHA-256$"):
+			e.scram, err = pggateway.ParseSCRAMVerifier(e.password)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err)
+			}
+		case strings.HasPrefix(e.password, "md5") && len(e.password) == 35:
+		case strings.HasPrefix(e.password, "$2a$"), strings.HasPrefix(e.password, "$2b$"), strings.HasPrefix(e.password, "$2y$"):
+		default:
+			return nil, fmt.Errorf("line %d: unsupported password format for user %#v", lineNum, fields[0])
+		}
+
+		if len(fields) == 3 {
+			if _, ok := p.accounts[fields[2]]; !ok {
+				return nil, fmt.Errorf("line %d: unknown account %#v", lineNum, fields[2])
+			}
+			e.account = fields[2]
+		}
+		users[fields[0]] = e
+	}
+	return users, scanner.Err()
+}
+
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			return nil, fmt.Errorf("expected quoted value")
+		}
+
+		var value []byte
+		i := 1
+		for {
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quoted value")
+			}
+			if line[i] == '"' {
+				if i+1 < len(line) && line[i+1] == '"' {
+					value = append(value, '"')
+					i += 2
+					continue
+				}
+				break
+			}
+			value = append(value, line[i])
+			i++
+		}
+		fields = append(fields, string(value))
+		line = line[i+1:]
+	}
+}
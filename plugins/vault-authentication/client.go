@@ -0,0 +1,109 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type vaultClient struct {
+	address   string
+	token     string
+	namespace string
+	mount     string
+	http      *http.Client
+}
+
+type secretResponse struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+}
+
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// credentials generates new database credentials for the role from the database secrets engine
+func (c *vaultClient) credentials(role string) (*secretResponse, error) {
+	secret := &secretResponse{}
+	err := c.do("GET", fmt.Sprintf("/v1/%s/creds/%s", c.mount, role), nil, secret)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Data.Username == "" {
+		return nil, fmt.Errorf("vault returned no username for role %#v", role)
+	}
+	return secret, nil
+}
+
+// renew extends the lease, returning the new lease duration which may be shorter than requested
+func (c *vaultClient) renew(leaseID string, increment time.Duration) (time.Duration, error) {
+	secret := &secretResponse{}
+	err := c.do("PUT", "/v1/sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": int(increment.Seconds()),
+	}, secret)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secret.LeaseDuration) * time.Second, nil
+}
+
+// revoke revokes the lease, which drops the database user
+func (c *vaultClient) revoke(leaseID string) error {
+	return c.do("PUT", "/v1/sys/leases/revoke", map[string]interface{}{
+		"lease_id": leaseID,
+	}, nil)
+}
+
+func (c *vaultClient) do(method string, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.address, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.token)
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errResp := &errorResponse{}
+		json.NewDecoder(resp.Body).Decode(errResp)
+		if len(errResp.Errors) > 0 {
+			return fmt.Errorf("vault %s %s: %s", method, path, strings.Join(errResp.Errors, ", "))
+		}
+		return fmt.Errorf("vault %s %s: unexpected status %s", method, path, resp.Status)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,272 @@
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+type lease struct {
+	role     string
+	id       string
+	user     []byte
+	password []byte
+	expires  time.Time
+
+	// Sessions currently using the credentials, the lease is revoked once the last one ends
+	refs int
+	// Set once the lease can no longer be renewed, new sessions get new credentials
+	expiring bool
+	stop     chan struct{}
+}
+
+// leaseRequest is a request to Vault for new credentials, sessions needing credentials for the role meanwhile wait for its lease
+type leaseRequest struct {
+	done    chan struct{}
+	waiting int
+	lease   *lease
+	err     error
+}
+
+type VaultAuth struct {
+	client pggateway.AuthenticationPlugin
+	vault  *vaultClient
+
+	// Map of target server users to Vault roles, with a default role for any other user
+	roles map[string]string
+	role  string
+
+	// Minimum remaining lease time for cached credentials to be handed to a new session
+	minTTL time.Duration
+
+	leases   map[string]*lease
+	requests map[string]*leaseRequest
+	mutex    *sync.Mutex
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("vault", newVaultPlugin)
+}
+
+func newVaultPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	auth := &VaultAuth{
+		roles:    make(map[string]string),
+		leases:   make(map[string]*lease),
+		requests: make(map[string]*leaseRequest),
+		mutex:    &sync.Mutex{},
+	}
+
+	clientConfig, ok := config.Map("authenticate")
+	if !ok {
+		return nil, fmt.Errorf("'authenticate' configuration value is required")
+	}
+	clientPlugin, ok := clientConfig.String("plugin")
+	if !ok {
+		return nil, fmt.Errorf("'authenticate.plugin' configuration value is required")
+	}
+	if clientPlugin == "passthrough" || clientPlugin == "vault" {
+		return nil, fmt.Errorf("'authenticate.plugin' cannot be %#v", clientPlugin)
+	}
+	var err error
+	auth.client, err = pggateway.NewAuthenticationPlugin(clientPlugin, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	auth.vault = &vaultClient{
+		address:   config.StringDefault("address", os.Getenv("VAULT_ADDR")),
+		token:     config.StringDefault("token", os.Getenv("VAULT_TOKEN")),
+		namespace: config.StringDefault("namespace", ""),
+		mount:     config.StringDefault("mount", "database"),
+	}
+	if auth.vault.address == "" {
+		return nil, fmt.Errorf("'address' configuration value is required")
+	}
+	if auth.vault.token == "" {
+		return nil, fmt.Errorf("'token' configuration value is required")
+	}
+
+	transport := &http.Transport{}
+	if ca, ok := config.String("ca"); ok {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %#v", ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	auth.vault.http = &http.Client{
+		Transport: transport,
+		Timeout:   config.DurationDefault("timeout", 10*time.Second),
+	}
+
+	auth.role = config.StringDefault("role", "")
+	roles, _ := config.Map("roles")
+	for user := range roles {
+		role, ok := roles.String(user)
+		if !ok {
+			return nil, fmt.Errorf("'roles.%s' must be a string", user)
+		}
+		auth.roles[user] = role
+	}
+	if auth.role == "" && len(auth.roles) == 0 {
+		return nil, fmt.Errorf("one of 'role' or 'roles' configuration values is required")
+	}
+
+	auth.minTTL = config.DurationDefault("min_ttl", time.Minute)
+
+	return auth, nil
+}
+
+// MessageInspection is the wrapped plugin's, which authenticates the client
+func (p *VaultAuth) MessageInspection() pggateway.MessageInspection {
+	if client, ok := p.client.(pggateway.MessageInspectingPlugin); ok {
+		return client.MessageInspection()
+	}
+	return pggateway.MessageInspectionFull
+}
+
+// Authenticate authenticates the client with the wrapped plugin, which logs in to the target server
+// with credentials generated by Vault for the role of the user it chose
+func (p *VaultAuth) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	sess.SetCredentialProvider(func(user []byte) ([]byte, []byte, error) {
+		role, ok := p.roles[string(user)]
+		if !ok {
+			role = p.role
+		}
+		if role == "" {
+			return nil, nil, fmt.Errorf("no vault role configured for user %#v", string(user))
+		}
+
+		l, err := p.acquire(role)
+		if err != nil {
+			return nil, nil, err
+		}
+		sess.OnClose(func() {
+			err := p.release(l, func() {
+				// Connections kept by the pool would otherwise outlive the revoked database user
+				sess.DiscardPooledConnections(l.user)
+			})
+			if err != nil {
+				sess.LogError("error revoking vault lease %#v: %s", l.id, err)
+			}
+		})
+		sess.LogInfo("using vault credentials for role %#v, user %#v", role, string(l.user))
+		return l.user, l.password, nil
+	})
+	return p.client.Authenticate(sess, startup)
+}
+
+// acquire returns cached credentials for the role, or generates new ones if none have enough time left.
+// Vault is asked for credentials for the same role once at a time, without holding the lock
+func (p *VaultAuth) acquire(role string) (*lease, error) {
+	p.mutex.Lock()
+	l, ok := p.leases[role]
+	if ok && !l.expiring && time.Until(l.expires) > p.minTTL {
+		l.refs++
+		p.mutex.Unlock()
+		return l, nil
+	}
+	if req, ok := p.requests[role]; ok {
+		// The request counts the lease's reference for us
+		req.waiting++
+		p.mutex.Unlock()
+		<-req.done
+		return req.lease, req.err
+	}
+	req := &leaseRequest{done: make(chan struct{})}
+	p.requests[role] = req
+	p.mutex.Unlock()
+
+	secret, err := p.vault.credentials(role)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.requests, role)
+	defer close(req.done)
+	if err != nil {
+		req.err = err
+		return nil, err
+	}
+	ttl := time.Duration(secret.LeaseDuration) * time.Second
+	l = &lease{
+		role:     role,
+		id:       secret.LeaseID,
+		user:     []byte(secret.Data.Username),
+		password: []byte(secret.Data.Password),
+		expires:  time.Now().Add(ttl),
+		refs:     1 + req.waiting,
+		expiring: !secret.Renewable,
+		stop:     make(chan struct{}),
+	}
+	req.lease = l
+	p.leases[role] = l
+	if secret.Renewable {
+		go p.renew(l, ttl)
+	}
+	return l, nil
+}
+
+// release revokes the lease once no sessions are using it, calling discard first to close any connections using the credentials
+func (p *VaultAuth) release(l *lease, discard func()) error {
+	p.mutex.Lock()
+	l.refs--
+	if l.refs > 0 {
+		p.mutex.Unlock()
+		return nil
+	}
+	if p.leases[l.role] == l {
+		delete(p.leases, l.role)
+	}
+	close(l.stop)
+	p.mutex.Unlock()
+
+	discard()
+	if l.id == "" {
+		return nil
+	}
+	return p.vault.revoke(l.id)
+}
+
+// renew keeps renewing the lease halfway through its remaining time until it is released or reaches its max TTL
+func (p *VaultAuth) renew(l *lease, increment time.Duration) {
+	wait := increment / 2
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		ttl, err := p.vault.renew(l.id, increment)
+
+		p.mutex.Lock()
+		if err != nil || ttl <= 0 {
+			l.expiring = true
+			p.mutex.Unlock()
+			return
+		}
+		l.expires = time.Now().Add(ttl)
+		// Vault caps renewals at the max TTL, once reached stop handing the credentials out
+		if ttl < increment {
+			l.expiring = true
+		}
+		p.mutex.Unlock()
+
+		if ttl < increment {
+			return
+		}
+		wait = ttl / 2
+	}
+}
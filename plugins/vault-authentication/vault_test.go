@@ -0,0 +1,244 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testVault stands in for the Vault database secrets engine and lease endpoints
+type testVault struct {
+	mutex         *sync.Mutex
+	issued        int
+	leaseDuration int
+	// Lease durations returned by successive renewals
+	renewals []int
+	renewed  []string
+	events   []string
+	// Closed to answer requests for credentials for the `slow` role
+	slow chan struct{}
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/creds/slow") {
+		<-v.slow
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if r.Header.Get("X-Vault-Token") != "test-token" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/database/creds/"):
+		v.issued++
+		role := strings.TrimPrefix(r.URL.Path, "/v1/database/creds/")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"lease_id":       fmt.Sprintf("database/creds/%s/%d", role, v.issued),
+			"lease_duration": v.leaseDuration,
+			"renewable":      true,
+			"data": map[string]string{
+				"username": fmt.Sprintf("v-%s-%d", role, v.issued),
+				"password": "secret",
+			},
+		})
+	case r.Method == "PUT" && r.URL.Path == "/v1/sys/leases/renew":
+		v.renewed = append(v.renewed, body["lease_id"].(string))
+		duration := 0
+		if len(v.renewals) > 0 {
+			duration, v.renewals = v.renewals[0], v.renewals[1:]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"lease_id": body["lease_id"], "lease_duration": duration})
+	case r.Method == "PUT" && r.URL.Path == "/v1/sys/leases/revoke":
+		v.events = append(v.events, "revoke "+body["lease_id"].(string))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (v *testVault) log(event string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.events = append(v.events, event)
+}
+
+// recorded returns the number of credentials issued and the events so far
+func (v *testVault) recorded() (int, string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.issued, strings.Join(v.events, ",")
+}
+
+func newTestVaultAuth(t *testing.T, vault *testVault, token string) (*VaultAuth, func()) {
+	server := httptest.NewServer(vault)
+	return &VaultAuth{
+		vault: &vaultClient{
+			address: server.URL,
+			token:   token,
+			mount:   "database",
+			http:    server.Client(),
+		},
+		minTTL:   time.Minute,
+		leases:   make(map[string]*lease),
+		requests: make(map[string]*leaseRequest),
+		mutex:    &sync.Mutex{},
+	}, server.Close
+}
+
+func TestVaultLeaseSharedAndRevoked(t *testing.T) {
+	vault := &testVault{mutex: &sync.Mutex{}, leaseDuration: 3600}
+	auth, stop := newTestVaultAuth(t, vault, "test-token")
+	defer stop()
+
+	first, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued, _ := vault.recorded(); first != second || string(first.user) != "v-app-1" || issued != 1 {
+		t.Fatalf("expected concurrent sessions to share credentials, got %#v and %#v after %d issued", string(first.user), string(second.user), issued)
+	}
+
+	discard := func() { vault.log("discard " + string(first.user)) }
+	err = auth.release(first, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, events := vault.recorded(); events != "" {
+		t.Fatalf("expected the lease to be kept while in use, got %#v", events)
+	}
+	err = auth.release(second, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pooled connections are closed before the database user is dropped
+	expected := "discard v-app-1,revoke database/creds/app/1"
+	if _, events := vault.recorded(); events != expected {
+		t.Fatalf("expected %#v, got %#v", expected, events)
+	}
+
+	third, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(third.user) != "v-app-2" {
+		t.Fatalf("expected new credentials once the lease was revoked, got %#v", string(third.user))
+	}
+}
+
+func TestVaultLeaseRenewal(t *testing.T) {
+	// Renewed in full once, then capped by the max TTL
+	vault := &testVault{mutex: &sync.Mutex{}, leaseDuration: 1, renewals: []int{1, 0}}
+	auth, stop := newTestVaultAuth(t, vault, "test-token")
+	defer stop()
+
+	l, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		auth.mutex.Lock()
+		expiring := l.expiring
+		auth.mutex.Unlock()
+		if expiring {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lease to stop being handed out once it can no longer be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	vault.mutex.Lock()
+	renewed := vault.renewed
+	vault.mutex.Unlock()
+	if len(renewed) != 2 || renewed[0] != "database/creds/app/1" {
+		t.Fatalf("expected two renewals of the lease, got %#v", renewed)
+	}
+
+	next, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == l || string(next.user) != "v-app-2" {
+		t.Fatalf("expected new credentials for new sessions once the lease is expiring, got %#v", string(next.user))
+	}
+}
+
+func TestVaultSlowRequests(t *testing.T) {
+	vault := &testVault{mutex: &sync.Mutex{}, leaseDuration: 3600, slow: make(chan struct{})}
+	auth, stop := newTestVaultAuth(t, vault, "test-token")
+	defer stop()
+
+	app, err := auth.acquire("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions for the slow role share one request to Vault
+	leases := make(chan *lease, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			l, err := auth.acquire("slow")
+			if err != nil {
+				t.Error(err)
+			}
+			leases <- l
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Other roles and releasing leases are not held up meanwhile
+	done := make(chan error)
+	go func() {
+		err := auth.release(app, func() {})
+		if err == nil {
+			_, err = auth.acquire("app")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("vault requests for other roles blocked on the slow request")
+	}
+
+	close(vault.slow)
+	first, second := <-leases, <-leases
+	if first == nil || first != second || first.refs != 2 {
+		t.Fatalf("expected both sessions to share the slow role's lease")
+	}
+	if issued, _ := vault.recorded(); issued != 3 {
+		t.Fatalf("expected one request for the slow role's credentials, got %d requests in total", issued)
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	vault := &testVault{mutex: &sync.Mutex{}, leaseDuration: 3600}
+	auth, stop := newTestVaultAuth(t, vault, "wrong-token")
+	defer stop()
+
+	_, err := auth.acquire("app")
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected vault's error, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+type Webhook struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+type clientInfo struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+type certificateInfo struct {
+	Subject     string   `json:"subject"`
+	Issuer      string   `json:"issuer"`
+	Serial      string   `json:"serial"`
+	DNSNames    []string `json:"dns_names,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	URIs        []string `json:"uris,omitempty"`
+	NotAfter    string   `json:"not_after"`
+	Fingerprint string   `json:"fingerprint_sha256"`
+}
+
+type tlsInfo struct {
+	Version         string           `json:"version"`
+	CipherSuite     string           `json:"cipher_suite"`
+	ServerName      string           `json:"server_name,omitempty"`
+	PeerCertificate *certificateInfo `json:"peer_certificate,omitempty"`
+}
+
+type webhookRequest struct {
+	SessionID string            `json:"session_id"`
+	User      string            `json:"user"`
+	Database  string            `json:"database"`
+	Password  string            `json:"password"`
+	Options   map[string]string `json:"options"`
+	Client    clientInfo        `json:"client"`
+	SSL       bool              `json:"ssl"`
+	TLS       *tlsInfo          `json:"tls,omitempty"`
+}
+
+type webhookResponse struct {
+	Allow    bool              `json:"allow"`
+	Message  string            `json:"message"`
+	User     string            `json:"user"`
+	Password *string           `json:"password"`
+	Target   string            `json:"target"`
+	Options  map[string]string `json:"options"`
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("webhook", newWebhookPlugin)
+}
+
+func newWebhookPlugin(config pggateway.ConfigMap) (pggateway.AuthenticationPlugin, error) {
+	var ok bool
+	auth := &Webhook{
+		headers: make(map[string]string),
+	}
+
+	auth.url, ok = config.String("url")
+	if !ok {
+		return nil, fmt.Errorf("'url' configuration value is required")
+	}
+	u, err := url.Parse(auth.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'url' %#v: %s", auth.url, err)
+	}
+	// Client passwords are sent to the endpoint, only over plain HTTP when asked to
+	if u.Scheme != "https" && !config.BoolDefault("allow_http", false) {
+		return nil, fmt.Errorf("'url' must use https, set 'allow_http' to send passwords over plain HTTP")
+	}
+
+	headers, _ := config.Map("headers")
+	for name := range headers {
+		value, ok := headers.String(name)
+		if !ok {
+			return nil, fmt.Errorf("'headers.%s' must be a string", name)
+		}
+		auth.headers[name] = value
+	}
+
+	transport := &http.Transport{}
+	if ca, ok := config.String("ca"); ok {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %#v", ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	auth.client = &http.Client{
+		Transport: transport,
+		Timeout:   config.DurationDefault("timeout", 10*time.Second),
+	}
+
+	return auth, nil
+}
+
+func (p *Webhook) MessageInspection() pggateway.MessageInspection {
+	return pggateway.MessageInspectionNone
+}
+
+func (p *Webhook) Authenticate(sess *pggateway.Session, startup *pgproto.StartupMessage) (bool, error) {
+	if !sess.IsSSL {
+		return false, fmt.Errorf("webhook auth requires an SSL session")
+	}
+
+	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := p.call(p.newRequest(sess, startup, passwd.Password))
+	if err != nil {
+		return false, err
+	}
+	if !resp.Allow {
+		sess.LogInfo("webhook denied session: %s", resp.Message)
+		return false, nil
+	}
+
+	if resp.Target != "" {
+		err = sess.SetTargetAddress(resp.Target)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	user := sess.User
+	if resp.User != "" {
+		user = []byte(resp.User)
+	}
+	password := passwd.Password
+	if resp.Password != nil {
+		password = []byte(*resp.Password)
+	}
+
+	if len(resp.Options) > 0 {
+		options := make(map[string][]byte)
+		for k, v := range startup.Options {
+			options[k] = v
+		}
+		for k, v := range resp.Options {
+			options[k] = []byte(v)
+		}
+		startup = &pgproto.StartupMessage{Options: options}
+	}
+
+	err = sess.LoginToServer(startup, user, password)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *Webhook) newRequest(sess *pggateway.Session, startup *pgproto.StartupMessage, password []byte) *webhookRequest {
+	req := &webhookRequest{
+		SessionID: sess.ID,
+		User:      string(sess.User),
+		Database:  string(sess.Database),
+		Password:  string(password),
+		Options:   make(map[string]string),
+		SSL:       sess.IsSSL,
+	}
+	for k, v := range startup.Options {
+		req.Options[k] = string(v)
+	}
+
+	host, port, err := net.SplitHostPort(sess.ClientAddress().String())
+	if err == nil {
+		req.Client.Address = host
+		req.Client.Port, _ = strconv.Atoi(port)
+	}
+
+	if state, ok := sess.TLSConnectionState(); ok {
+		req.TLS = &tlsInfo{
+			Version:     tlsVersions[state.Version],
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			ServerName:  state.ServerName,
+		}
+		if cert := sess.ClientCertificate(); cert != nil {
+			req.TLS.PeerCertificate = newCertificateInfo(cert)
+		}
+	}
+	return req
+}
+
+func (p *Webhook) call(req *webhookRequest) (*webhookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest("POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for name, value := range p.headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	// Any response other than 200 is an error of the webhook, not a denial
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook returned unexpected status %s", httpResp.Status)
+	}
+
+	resp := &webhookResponse{}
+	err = json.NewDecoder(httpResp.Body).Decode(resp)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding webhook response: %s", err)
+	}
+	return resp, nil
+}
+
+func newCertificateInfo(cert *x509.Certificate) *certificateInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	info := &certificateInfo{
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.String(),
+		DNSNames:    cert.DNSNames,
+		Emails:      cert.EmailAddresses,
+		NotAfter:    cert.NotAfter.UTC().Format(time.RFC3339),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	for _, u := range cert.URIs {
+		info.URIs = append(info.URIs, u.String())
+	}
+	return info
+}
@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pggatewaytest"
+)
+
+// newTestWebhook returns the plugin for an endpoint answering with the response handler's result
+func newTestWebhook(t *testing.T, dir string, timeout string, respond func(w http.ResponseWriter, req *webhookRequest)) (*Webhook, *httptest.Server) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := &webhookRequest{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil || req.User != "alice" || req.Password != "secret" || req.Options["database"] != "app" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		respond(w, req)
+	}))
+
+	ca := filepath.Join(dir, "ca.crt")
+	err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newWebhookPlugin(pggateway.ConfigMap{
+		"url":     server.URL,
+		"ca":      ca,
+		"timeout": timeout,
+		"headers": map[interface{}]interface{}{"Authorization": "Bearer test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*Webhook), server
+}
+
+func TestWebhookAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := pggatewaytest.NewTarget(t)
+	defer target.Close()
+	redirect := pggatewaytest.NewTarget(t)
+	defer redirect.Close()
+
+	for _, test := range []struct {
+		name     string
+		response string
+		status   int
+		success  bool
+		err      string
+		// Target server the session logs in to and the startup options it sends, none when it does not log in
+		target  *pggatewaytest.Target
+		startup map[string]string
+	}{
+		{
+			name:     "allow",
+			response: `{"allow": true}`,
+			success:  true,
+			target:   target,
+			startup:  map[string]string{"user": "alice", "database": "app"},
+		},
+		{
+			name:     "allow as another user",
+			response: `{"allow": true, "user": "app", "password": "other", "options": {"search_path": "alice"}}`,
+			success:  true,
+			target:   target,
+			startup:  map[string]string{"user": "app", "database": "app", "search_path": "alice"},
+		},
+		{
+			name:     "deny",
+			response: `{"allow": false, "message": "not today"}`,
+		},
+		{
+			name:     "redirect",
+			response: `{"allow": true, "target": "` + redirect.Addr() + `"}`,
+			success:  true,
+			target:   redirect,
+			startup:  map[string]string{"user": "alice", "database": "app"},
+		},
+		{
+			name:   "unexpected status",
+			status: http.StatusInternalServerError,
+			err:    "unexpected status 500",
+		},
+		{
+			name:     "malformed response",
+			response: `allow`,
+			err:      "error decoding webhook response",
+		},
+	} {
+		p, server := newTestWebhook(t, dir, "5s", func(w http.ResponseWriter, req *webhookRequest) {
+			if test.status != 0 {
+				w.WriteHeader(test.status)
+				return
+			}
+			w.Write([]byte(test.response))
+		})
+		sess, startup := pggatewaytest.NewSession(t, target, map[string]string{"user": "alice", "database": "app"}, "secret")
+		success, err := p.Authenticate(sess, startup)
+		sess.Close()
+		server.Close()
+		if success != test.success || (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected success %v and error %#v, got %v and %v", test.name, test.success, test.err, success, err)
+			continue
+		}
+
+		for _, server := range []*pggatewaytest.Target{target, redirect} {
+			select {
+			case startup := <-server.Startups:
+				if server != test.target {
+					t.Errorf("%s: expected no login to %s, got %#v", test.name, server.Addr(), startup)
+				} else if !equalOptions(startup, test.startup) {
+					t.Errorf("%s: expected startup options %#v, got %#v", test.name, test.startup, startup)
+				}
+			case <-time.After(50 * time.Millisecond):
+				if server == test.target {
+					t.Errorf("%s: expected a login to %s", test.name, server.Addr())
+				}
+			}
+		}
+	}
+}
+
+func equalOptions(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := pggatewaytest.NewTarget(t)
+	defer target.Close()
+
+	done := make(chan struct{})
+	p, server := newTestWebhook(t, dir, "100ms", func(w http.ResponseWriter, req *webhookRequest) {
+		<-done
+	})
+	defer server.Close()
+	defer close(done)
+
+	sess, startup := pggatewaytest.NewSession(t, target, map[string]string{"user": "alice", "database": "app"}, "secret")
+	defer sess.Close()
+	start := time.Now()
+	success, err := p.Authenticate(sess, startup)
+	if success || err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the request to time out, got %v and %v after %s", success, err, time.Since(start))
+	}
+}
+
+func TestWebhookRequiresHTTPS(t *testing.T) {
+	_, err := newWebhookPlugin(pggateway.ConfigMap{"url": "http://auth.example.com/pggateway"})
+	if err == nil || !strings.Contains(err.Error(), "must use https") {
+		t.Fatalf("expected an http url to be rejected, got %v", err)
+	}
+
+	_, err = newWebhookPlugin(pggateway.ConfigMap{"url": "http://auth.example.com/pggateway", "allow_http": true})
+	if err != nil {
+		t.Fatalf("expected an http url to be allowed with 'allow_http', got %v", err)
+	}
+}
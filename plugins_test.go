@@ -0,0 +1,93 @@
+package pggateway
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/c653labs/pgproto"
+)
+
+func TestAuthRulesDenyWithoutMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-hba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+
+	// No rules configured, every plugin is tried instead
+	r, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.matchAuthRule([]byte("alice"), []byte("app"), addr, true); ok {
+		t.Error("expected no rules without 'authentication_rules' or 'hba'")
+	}
+
+	// An empty list of rules allows nothing
+	r, err = NewPluginRegistry(nil, []AuthenticationRuleConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, ok := r.matchAuthRule([]byte("alice"), []byte("app"), addr, true); !ok || rule != nil {
+		t.Error("expected empty 'authentication_rules' to match no rule")
+	}
+
+	// Nor does an hba file without lines for the gateway
+	hba := writeTestFile(t, dir, "pg_hba.conf", []byte("# comment\nlocal all all trust\nhostgssenc all all 0.0.0.0/0 trust\n"))
+	r, err = NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.loadHBA(HBAConfig{File: hba})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule, ok := r.matchAuthRule([]byte("alice"), []byte("app"), addr, true); !ok || rule != nil {
+		t.Error("expected an hba file without host lines to match no rule")
+	}
+}
+
+type testAuthPlugin struct{}
+
+func (p *testAuthPlugin) Authenticate(*Session, *pgproto.StartupMessage) (bool, error) {
+	return false, nil
+}
+
+type testInspectingAuthPlugin struct {
+	testAuthPlugin
+	inspection MessageInspection
+}
+
+func (p *testInspectingAuthPlugin) MessageInspection() MessageInspection {
+	return p.inspection
+}
+
+func TestMessageInspection(t *testing.T) {
+	none := &testInspectingAuthPlugin{inspection: MessageInspectionNone}
+	frames := &testInspectingAuthPlugin{inspection: MessageInspectionFrames}
+	for _, test := range []struct {
+		plugins    []AuthenticationPlugin
+		inspection MessageInspection
+	}{
+		{nil, MessageInspectionNone},
+		{[]AuthenticationPlugin{none}, MessageInspectionNone},
+		{[]AuthenticationPlugin{none, frames}, MessageInspectionFrames},
+		// Plugins which do not declare what they need get everything
+		{[]AuthenticationPlugin{none, &testAuthPlugin{}}, MessageInspectionFull},
+	} {
+		r, err := NewPluginRegistry(nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range test.plugins {
+			r.authPlugins[string(rune('a'+i))] = p
+		}
+		if inspection := r.messageInspection(); inspection != test.inspection {
+			t.Errorf("expected inspection %d, got %d", test.inspection, inspection)
+		}
+	}
+}
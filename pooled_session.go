@@ -0,0 +1,424 @@
+package pggateway
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/c653labs/pgproto"
+)
+
+// pooledSession is the state of a session using backends from a pool, borrowing one for each transaction
+// in `transaction` mode, or holding one until it ends in `session` mode
+type pooledSession struct {
+	pool *backendPool
+
+	// Guarded by mutex
+	backend *backend
+	// Whether a goroutine is forwarding responses from the backend
+	reading bool
+	// Queries and Syncs sent without their ReadyForQuery yet
+	pending int
+	// Extended query messages sent since the last Sync
+	dirty bool
+	// Transaction status from the last ReadyForQuery
+	status byte
+	// Responses to messages rewritten or injected by the gateway, in order
+	expected []expectedResponse
+	// The client's named prepared statements
+	statements map[string]*pooledStatement
+	err        error
+	mutex      *sync.Mutex
+}
+
+type pooledStatement struct {
+	// Name of the statement on backends, see pooledStatementName
+	name string
+	// Parse payload preparing the statement with that name
+	parse []byte
+}
+
+type expectedResponse struct {
+	typ byte
+	// Gateway name of the statement prepared by a Parse
+	name string
+	// The response is to a message injected by the gateway and not sent to the client
+	drop bool
+}
+
+// pooledStatementName names prepared statements on backends by their query and parameter types, clients'
+// names would clash between sessions sharing a backend while the same statement can be reused by all of them
+func pooledStatementName(parse []byte) string {
+	sum := sha256.Sum256(parse)
+	return "pggateway_" + hex.EncodeToString(sum[:8])
+}
+
+// loginPooled completes the client's login from a pool of backends instead of its own target server connection
+func (s *Session) loginPooled(startup *pgproto.StartupMessage, user []byte, password []byte) error {
+	// From an earlier plugin which failed to log in
+	s.closePooled()
+
+	// Backends log in with the client's startup options, e.g. `application_name` or `DateStyle`, so each set has its own pool
+	options := make(map[string][]byte)
+	for k, v := range startup.Options {
+		if k != "user" {
+			options[k] = v
+		}
+	}
+	pool := s.backends.get(user, password, options, s.targetAttrs)
+	p := &pooledSession{
+		pool:       pool,
+		status:     'I',
+		statements: make(map[string]*pooledStatement),
+		mutex:      &sync.Mutex{},
+	}
+	// Given back to the pools when the session closes, along with any backend it holds
+	s.pooled = p
+	if s.backends.mode == poolModeSession {
+		backend, err := pool.acquire()
+		if err != nil {
+			s.writePoolError(err)
+			return err
+		}
+		p.mutex.Lock()
+		p.backend = backend
+		p.mutex.Unlock()
+	}
+
+	parameters, err := pool.getParameters()
+	if err != nil {
+		s.writePoolError(err)
+		return err
+	}
+
+	err = writeAuthenticationMessage(s.client, int32(pgproto.AuthenticationMethodOK), nil)
+	if err != nil {
+		return err
+	}
+	for _, payload := range parameters {
+		err = writeMessage(s.client, messageTypeParameterStatus, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The key cancels whatever backend the session is using at the time
+	key, err := s.issueCancelKey()
+	if err != nil {
+		return err
+	}
+	err = writeMessage(s.client, messageTypeBackendKeyData, key.payload())
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.client, messageTypeReadyForQuery, []byte{'I'})
+}
+
+// writePoolError tells the client why no backend could be used
+func (s *Session) writePoolError(err error) {
+	switch e := err.(type) {
+	case *serverLoginError:
+		writeMessage(s.client, messageTypeError, e.payload)
+	default:
+		code := sqlStateConnectionFailure
+		if err == errPoolWaitTimeout {
+			code = sqlStateTooManyConnections
+		}
+		writeErrorMessage(s.client, code, err.Error())
+	}
+}
+
+// proxyPooled relays the client's messages to the session's backend until the client terminates
+func (s *Session) proxyPooled() error {
+	p := s.pooled
+
+	for {
+		typ, payload, err := readMessage(s.client)
+		if err != nil {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			if p.err != nil {
+				return p.err
+			}
+			return err
+		}
+		if typ == messageTypeTerminate {
+			return nil
+		}
+
+		err = s.sendPooled(typ, payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sendPooled sends a client message to the session's backend, borrowing one if it has none.
+// The mutex is not held while waiting for a backend or writing to it, as the goroutine reading
+// the backend's responses needs it for every message and the backend stops reading while they are not read.
+func (s *Session) sendPooled(typ byte, payload []byte) error {
+	p := s.pooled
+	p.mutex.Lock()
+	if p.err != nil {
+		p.mutex.Unlock()
+		return p.err
+	}
+
+	if p.backend == nil {
+		// Only this goroutine hands the session a backend, so it still has none once one is acquired
+		p.mutex.Unlock()
+		b, err := p.pool.acquire()
+		if err != nil {
+			s.writePoolError(err)
+			return err
+		}
+		p.mutex.Lock()
+		p.backend = b
+	}
+
+	// Counted as pending before the mutex is released, so the backend is not returned to the pool before it is written
+	b := p.backend
+	buf := &bytes.Buffer{}
+	p.rewrite(buf, typ, payload)
+	if !p.reading && (p.pending > 0 || p.dirty) {
+		p.reading = true
+		go s.readBackend(b)
+	}
+	p.mutex.Unlock()
+
+	_, err := b.conn.Write(buf.Bytes())
+	if err != nil {
+		p.mutex.Lock()
+		discard := p.backend == b
+		if discard {
+			// A goroutine reading the backend stops once it is closed
+			p.backend = nil
+		}
+		p.mutex.Unlock()
+		if discard {
+			p.pool.discard(b)
+		}
+		return err
+	}
+	return nil
+}
+
+// rewrite writes a client message for the backend, renaming prepared statements and preparing the ones the backend is missing
+func (p *pooledSession) rewrite(buf *bytes.Buffer, typ byte, payload []byte) {
+	b := p.backend
+
+	switch typ {
+	case messageTypeQuery, messageTypeSync, messageTypeFunctionCall:
+		p.pending++
+		p.expected = append(p.expected, expectedResponse{typ: messageTypeReadyForQuery})
+		if typ == messageTypeSync {
+			p.dirty = false
+		}
+
+	case messageTypeParse:
+		p.dirty = true
+		name, rest, err := readCString(payload)
+		if err != nil || name == "" {
+			p.expected = append(p.expected, expectedResponse{typ: messageTypeParseComplete})
+			break
+		}
+
+		st := &pooledStatement{name: pooledStatementName(rest)}
+		st.parse = append(append([]byte(st.name), 0), rest...)
+		p.statements[name] = st
+		if b.prepared[st.name] {
+			// Already prepared by another client, prepare it again so the client gets its ParseComplete
+			writeMessage(buf, messageTypeClose, append(append([]byte{'S'}, st.name...), 0))
+			p.expected = append(p.expected, expectedResponse{typ: messageTypeCloseComplete, drop: true})
+		}
+		b.prepared[st.name] = true
+		p.expected = append(p.expected, expectedResponse{typ: messageTypeParseComplete, name: st.name})
+		payload = st.parse
+
+	case messageTypeBind:
+		p.dirty = true
+		portal, rest, err := readCString(payload)
+		if err != nil {
+			break
+		}
+		name, rest, err := readCString(rest)
+		if st, ok := p.statements[name]; err == nil && ok {
+			p.ensurePrepared(buf, st)
+			payload = append(append(append(append([]byte(portal), 0), st.name...), 0), rest...)
+		}
+
+	case messageTypeDescribe:
+		p.dirty = true
+		if len(payload) == 0 || payload[0] != 'S' {
+			break
+		}
+		name, _, err := readCString(payload[1:])
+		if st, ok := p.statements[name]; err == nil && ok {
+			p.ensurePrepared(buf, st)
+			payload = append(append([]byte{'S'}, st.name...), 0)
+		}
+
+	case messageTypeClose:
+		p.dirty = true
+		p.expected = append(p.expected, expectedResponse{typ: messageTypeCloseComplete})
+		if len(payload) > 0 && payload[0] == 'S' {
+			// Statements stay prepared on backends for other clients, the client's name does not exist
+			// on the backend so closing it is harmless
+			name, _, err := readCString(payload[1:])
+			if err == nil {
+				delete(p.statements, name)
+			}
+		}
+
+	case messageTypeExecute, messageTypeFlush:
+		p.dirty = true
+	}
+
+	writeMessage(buf, typ, payload)
+}
+
+// ensurePrepared prepares a client's statement on the backend if it has not been yet
+func (p *pooledSession) ensurePrepared(buf *bytes.Buffer, st *pooledStatement) {
+	if p.backend.prepared[st.name] {
+		return
+	}
+	writeMessage(buf, messageTypeParse, st.parse)
+	p.backend.prepared[st.name] = true
+	p.expected = append(p.expected, expectedResponse{typ: messageTypeParseComplete, name: st.name, drop: true})
+}
+
+// received tracks a response from the backend, returning whether it should be forwarded to the client
+func (p *pooledSession) received(typ byte) bool {
+	switch typ {
+	case messageTypeParseComplete, messageTypeCloseComplete:
+		if len(p.expected) > 0 && p.expected[0].typ == typ {
+			e := p.expected[0]
+			p.expected = p.expected[1:]
+			return !e.drop
+		}
+	case messageTypeReadyForQuery:
+		// Anything still expected was skipped by the backend after an error, including statements it did not prepare
+		for len(p.expected) > 0 {
+			e := p.expected[0]
+			p.expected = p.expected[1:]
+			if e.typ == messageTypeReadyForQuery {
+				break
+			}
+			if e.typ == messageTypeParseComplete && e.name != "" {
+				delete(p.backend.prepared, e.name)
+			}
+		}
+	}
+	return true
+}
+
+// readBackend forwards responses from the backend to the client until it has answered everything sent,
+// resetting the backend and returning it to the pool when the client is no longer in a transaction in `transaction` mode
+func (s *Session) readBackend(b *backend) {
+	p := s.pooled
+	for {
+		typ, payload, err := readMessage(b.conn)
+		if err != nil {
+			p.mutex.Lock()
+			if p.backend != b {
+				// The session ended and discarded the backend
+				p.mutex.Unlock()
+				return
+			}
+			p.backend = nil
+			p.reading = false
+			p.err = fmt.Errorf("target server connection lost: %s", err)
+			p.mutex.Unlock()
+
+			p.pool.discard(b)
+			writeErrorMessage(s.client, sqlStateConnectionFailure, p.err.Error())
+			s.client.Close()
+			return
+		}
+
+		p.mutex.Lock()
+		forward := p.received(typ)
+		if typ == messageTypeReadyForQuery && len(payload) > 0 {
+			if p.pending > 0 {
+				p.pending--
+			}
+			p.status = payload[0]
+			if p.pending == 0 && !p.dirty {
+				p.reading = false
+				release := p.pool.pools.mode == poolModeTransaction && p.status == 'I'
+				if release {
+					p.backend = nil
+				}
+				// Sent while locked, so it reaches the client before responses from the next backend
+				writeMessage(s.client, typ, payload)
+				p.mutex.Unlock()
+
+				if release {
+					s.releaseTransactionBackend(p.pool, b)
+				}
+				return
+			}
+		}
+		p.mutex.Unlock()
+
+		if forward {
+			err = writeMessage(s.client, typ, payload)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// releaseTransactionBackend returns a backend to the pool once a transaction ended, after clearing
+// what the client may have left for the next session such as settings, roles, temporary tables and locks
+func (s *Session) releaseTransactionBackend(pool *backendPool, b *backend) {
+	err := pool.resetTransaction(b)
+	if err != nil {
+		s.LogWarn("error resetting pooled target server connection: %s", err)
+		pool.discard(b)
+		return
+	}
+	pool.release(b)
+}
+
+// closePooled returns the backend still held when the session ends and gives back its pool
+func (s *Session) closePooled() {
+	if s.pooled == nil {
+		return
+	}
+	s.releaseBackend()
+	s.pooled.pool.pools.put(s.pooled.pool)
+}
+
+// releaseBackend returns the backend still held when the session ends to the pool, resetting it first
+func (s *Session) releaseBackend() {
+	p := s.pooled
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	b := p.backend
+	p.backend = nil
+	reading := p.reading
+	status := p.status
+	p.mutex.Unlock()
+	if b == nil {
+		return
+	}
+
+	if reading {
+		// Responses are still outstanding
+		p.pool.discard(b)
+		return
+	}
+	err := p.pool.reset(b, status)
+	if err != nil {
+		s.LogWarn("error resetting pooled target server connection: %s", err)
+		p.pool.discard(b)
+		return
+	}
+	p.pool.release(b)
+}
@@ -0,0 +1,391 @@
+package pggateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+// testBackendServer stands in for a target server, answering simple queries with `rows` rows of `rowSize` bytes
+type testBackendServer struct {
+	listener net.Listener
+	rows     int
+	rowSize  int
+	// Logins are only accepted over SSL when set
+	ssl *tls.Config
+
+	mutex    *sync.Mutex
+	conns    int
+	startups []map[string]string
+	queries  []string
+}
+
+func newTestBackendServer(t *testing.T, rows int, rowSize int) *testBackendServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testBackendServer{listener: l, rows: rows, rowSize: rowSize, mutex: &sync.Mutex{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns++
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testBackendServer) serve(conn net.Conn) {
+	defer conn.Close()
+	packet, err := readStartupPacket(conn)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	ssl := s.ssl
+	s.mutex.Unlock()
+	if ssl != nil {
+		if startupCode(packet) != sslRequestCode {
+			writeMessage(conn, messageTypeError, []byte("SFATAL\x00C28000\x00Mno pg_hba.conf entry for SSL off\x00\x00"))
+			return
+		}
+		conn.Write([]byte{'S'})
+		conn = tls.Server(conn, ssl)
+		packet, err = readStartupPacket(conn)
+		if err != nil {
+			return
+		}
+	}
+	options := make(map[string]string)
+	fields := strings.Split(string(packet[8:]), "\x00")
+	for i := 0; i+1 < len(fields) && fields[i] != ""; i += 2 {
+		options[fields[i]] = fields[i+1]
+	}
+	s.mutex.Lock()
+	s.startups = append(s.startups, options)
+	s.mutex.Unlock()
+
+	writeMessage(conn, messageTypeAuthentication, []byte{0, 0, 0, 0})
+	writeMessage(conn, messageTypeParameterStatus, []byte("server_version\x0016\x00"))
+	writeMessage(conn, messageTypeBackendKeyData, backendKey{pid: 1, secret: 2}.payload())
+	writeMessage(conn, messageTypeReadyForQuery, []byte{'I'})
+
+	row := append([]byte{0, 1, 0, 0, 0, 0}, bytes.Repeat([]byte{'x'}, s.rowSize)...)
+	row[5] = byte(s.rowSize)
+	row[4] = byte(s.rowSize >> 8)
+	status := byte('I')
+	for {
+		typ, payload, err := readMessage(conn)
+		if err != nil || typ == messageTypeTerminate {
+			return
+		}
+		if typ != messageTypeQuery {
+			continue
+		}
+		query := string(payload[:len(payload)-1])
+		s.mutex.Lock()
+		s.queries = append(s.queries, query)
+		s.mutex.Unlock()
+
+		switch {
+		case query == "BEGIN":
+			status = 'T'
+		case query == "COMMIT" || query == "ROLLBACK":
+			status = 'I'
+		case strings.HasPrefix(query, "SELECT"):
+			for i := 0; i < s.rows; i++ {
+				writeMessage(conn, messageTypeDataRow, row)
+			}
+		}
+		writeMessage(conn, 'C', []byte("OK\x00"))
+		writeMessage(conn, messageTypeReadyForQuery, []byte{status})
+	}
+}
+
+func (s *testBackendServer) log() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// newTestPooledClient starts a pooled session with the startup options and returns the client's end of its connection
+// once it is ready for queries
+func newTestPooledClient(t *testing.T, pools *backendPools, options map[string]string) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startup := &pgproto.StartupMessage{Options: map[string][]byte{"user": []byte("app"), "database": []byte("app")}}
+	for k, v := range options {
+		startup.Options[k] = []byte(v)
+	}
+	sess, err := NewSession(startup, []byte("app"), []byte("app"), false, conn, nil, pools.plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.backends = pools
+	sess.targetAttrs = sessionAttrsAny
+	go func() {
+		defer sess.Close()
+		err := sess.LoginToServer(startup, []byte("app"), []byte("password"))
+		if err == nil {
+			sess.proxyPooled()
+		}
+	}()
+
+	for {
+		typ, _, err := readMessage(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ == messageTypeReadyForQuery {
+			return client
+		}
+	}
+}
+
+func newTestBackendPools(t *testing.T, server *testBackendServer, mode string) *backendPools {
+	plugins, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.listener.Addr().(*net.TCPAddr)
+	targets, err := newTargetPool(TargetConfig{Host: "127.0.0.1", Port: addr.Port}, nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools, err := newBackendPools(PoolConfig{Mode: mode, Size: 1, WaitTimeout: "5s"}, targets, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pools
+}
+
+func TestPooledSessionPipelinedLargeResults(t *testing.T) {
+	server := newTestBackendServer(t, 64, 1024)
+	defer server.listener.Close()
+	pools := newTestBackendPools(t, server, poolModeTransaction)
+	client := newTestPooledClient(t, pools, nil)
+	defer client.Close()
+
+	// Enough queries and results to fill the socket buffers in both directions
+	const queries = 200
+	query := append([]byte("SELECT 1 -- "+strings.Repeat("x", 64*1024)), 0)
+	go func() {
+		for i := 0; i < queries; i++ {
+			err := writeMessage(client, messageTypeQuery, query)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	client.SetReadDeadline(time.Now().Add(20 * time.Second))
+	for ready := 0; ready < queries; {
+		typ, _, err := readMessage(client)
+		if err != nil {
+			t.Fatalf("after %d of %d queries: %s", ready, queries, err)
+		}
+		if typ == messageTypeReadyForQuery {
+			ready++
+		}
+	}
+}
+
+func TestPooledTransactionReset(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	pools := newTestBackendPools(t, server, poolModeTransaction)
+
+	query := func(client net.Conn, q string) {
+		err := writeMessage(client, messageTypeQuery, append([]byte(q), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			typ, _, err := readMessage(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ == messageTypeReadyForQuery {
+				return
+			}
+		}
+	}
+
+	a := newTestPooledClient(t, pools, nil)
+	defer a.Close()
+	query(a, "BEGIN")
+	query(a, "SET ROLE admin")
+	query(a, "COMMIT")
+	query(a, "SET search_path = private")
+
+	// Another session borrowing the same connection does not get the settings
+	b := newTestPooledClient(t, pools, nil)
+	defer b.Close()
+	query(b, "SELECT 1")
+
+	expected := []string{
+		"BEGIN", "SET ROLE admin", "COMMIT", transactionResetQuery,
+		"SET search_path = private", transactionResetQuery,
+		"SELECT 1",
+	}
+	queries := server.log()
+	if len(queries) < len(expected) || strings.Join(queries[:len(expected)], "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected queries %#v, got %#v", expected, queries)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.conns != 1 {
+		t.Fatalf("expected one target server connection, got %d", server.conns)
+	}
+}
+
+func TestBackendPoolsDropUnused(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	pools := newTestBackendPools(t, server, poolModeSession)
+	pools.minSize = 1
+	pools.idleTimeout = 200 * time.Millisecond
+
+	client := newTestPooledClient(t, pools, nil)
+	pools.maintainPools()
+	if len(pools.pools) != 1 {
+		t.Fatalf("expected the pool of the session, got %d pools", len(pools.pools))
+	}
+
+	// Closes the session, returning its backend to the pool
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	pools.maintainPools()
+	if len(pools.pools) != 1 {
+		t.Fatalf("expected the recently used pool to be kept, got %d pools", len(pools.pools))
+	}
+
+	// Once unused for longer than the idle timeout the backend is closed rather than kept warm, and the pool dropped
+	time.Sleep(250 * time.Millisecond)
+	pools.maintainPools()
+	if len(pools.pools) != 0 {
+		t.Fatalf("expected the unused pool to be dropped, got %d pools", len(pools.pools))
+	}
+}
+
+func TestPooledStartupOptions(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	pools := newTestBackendPools(t, server, poolModeSession)
+
+	a := newTestPooledClient(t, pools, map[string]string{"application_name": "a", "DateStyle": "ISO"})
+	defer a.Close()
+	b := newTestPooledClient(t, pools, map[string]string{"application_name": "b"})
+	defer b.Close()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(pools.pools) != 2 || len(server.startups) != 2 {
+		t.Fatalf("expected a pool and connection for each set of startup options, got %d pools and %d connections", len(pools.pools), len(server.startups))
+	}
+	for _, expected := range []map[string]string{
+		{"user": "app", "database": "app", "application_name": "a", "DateStyle": "ISO"},
+		{"user": "app", "database": "app", "application_name": "b"},
+	} {
+		found := false
+		for _, startup := range server.startups {
+			found = found || reflect.DeepEqual(startup, expected)
+		}
+		if !found {
+			t.Errorf("expected a login with %#v, got %#v", expected, server.startups)
+		}
+	}
+}
+
+func TestBackendPoolsDiscardUser(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	pools := newTestBackendPools(t, server, poolModeSession)
+	pools.size = 2
+
+	a := newTestPooledClient(t, pools, nil)
+	defer a.Close()
+	b := newTestPooledClient(t, pools, nil)
+	// Closes the session, leaving its backend idle in the pool
+	b.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	pools.mutex.Lock()
+	var pool *backendPool
+	for _, p := range pools.pools {
+		pool = p
+	}
+	pools.mutex.Unlock()
+
+	pools.discardUser([]byte("app"))
+	if len(pools.pools) != 0 {
+		t.Fatalf("expected the user's pool to be dropped, got %d pools", len(pools.pools))
+	}
+
+	// The backend in use is closed rather than kept once its session ends
+	a.Close()
+	time.Sleep(50 * time.Millisecond)
+	pool.mutex.Lock()
+	idle := len(pool.idle)
+	pool.mutex.Unlock()
+	if idle != 0 {
+		t.Fatalf("expected the discarded pool's backends to be closed, got %d idle", idle)
+	}
+
+	c := newTestPooledClient(t, pools, nil)
+	defer c.Close()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.conns != 3 {
+		t.Fatalf("expected a new connection for sessions after the pool was discarded, got %d connections", server.conns)
+	}
+}
+
+func TestDiscardPooledConnectionsOfAllDatabases(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	// Databases without plugins of their own share the listener's, and with them the credentials plugins hand out
+	app := newTestBackendPools(t, server, poolModeSession)
+	reports := newTestBackendPools(t, server, poolModeSession)
+	reports.plugins = app.plugins
+	app.plugins.backendPools = []*backendPools{app, reports}
+
+	newTestPooledClient(t, app, nil).Close()
+	newTestPooledClient(t, reports, nil).Close()
+	time.Sleep(50 * time.Millisecond)
+
+	sess, err := NewSession(nil, []byte("app"), []byte("app"), false, nil, nil, app.plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.DiscardPooledConnections([]byte("app"))
+	if len(app.pools) != 0 || len(reports.pools) != 0 {
+		t.Fatalf("expected the user's pools of both databases to be dropped, got %d and %d pools", len(app.pools), len(reports.pools))
+	}
+}
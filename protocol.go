@@ -0,0 +1,153 @@
+package pggateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Authentication request methods which are not understood by pgproto
+const (
+	authenticationMethodSASL         int32 = 10
+	authenticationMethodSASLContinue int32 = 11
+	authenticationMethodSASLFinal    int32 = 12
+)
+
+// Message type identifiers for raw protocol messages
+const (
+	messageTypeAuthentication  byte = 'R'
+	messageTypeError           byte = 'E'
+	messageTypePassword        byte = 'p'
+	messageTypeQuery           byte = 'Q'
+	messageTypeParameterStatus byte = 'S'
+	messageTypeNoticeResponse  byte = 'N'
+	messageTypeReadyForQuery   byte = 'Z'
+	messageTypeTerminate       byte = 'X'
+	messageTypeDataRow         byte = 'D'
+	messageTypeParseComplete   byte = '1'
+	messageTypeCloseComplete   byte = '3'
+	messageTypeBackendKeyData  byte = 'K'
+
+	messageTypeNegotiateProtocolVersion byte = 'v'
+)
+
+// Message type identifiers for raw extended query protocol messages from clients
+const (
+	messageTypeParse        byte = 'P'
+	messageTypeBind         byte = 'B'
+	messageTypeDescribe     byte = 'D'
+	messageTypeExecute      byte = 'E'
+	messageTypeClose        byte = 'C'
+	messageTypeFlush        byte = 'H'
+	messageTypeSync         byte = 'S'
+	messageTypeFunctionCall byte = 'F'
+)
+
+// Upper bound on the size of a single message we are willing to buffer
+const maxMessageLength = 1 << 30
+
+// Upper bound on the size of an authentication message from a client which has not authenticated yet, like PostgreSQL's
+const maxAuthMessageLength = 65535
+
+// readMessage reads a single type-prefixed protocol message and returns its
+// type identifier and payload (without the length header)
+func readMessage(r io.Reader) (byte, []byte, error) {
+	return readMessageLimit(r, maxMessageLength)
+}
+
+// readAuthMessage reads a message from a client which has not authenticated yet,
+// so an unauthenticated client cannot make the gateway buffer large messages
+func readAuthMessage(r io.Reader) (byte, []byte, error) {
+	return readMessageLimit(r, maxAuthMessageLength)
+}
+
+func readMessageLimit(r io.Reader, limit int) (byte, []byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > limit {
+		return 0, nil, fmt.Errorf("invalid message length %d", length)
+	}
+
+	payload := make([]byte, length-4)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// writeMessage writes a single type-prefixed protocol message
+func writeMessage(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)+4))
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// writeAuthenticationMessage writes an authentication request with the given method and data
+func writeAuthenticationMessage(w io.Writer, method int32, data []byte) error {
+	payload := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(payload, uint32(method))
+	payload = append(payload, data...)
+	return writeMessage(w, messageTypeAuthentication, payload)
+}
+
+// SQLSTATE error codes sent by the gateway itself
+const (
+	sqlStateConnectionFailure   = "08006"
+	sqlStateTooManyConnections  = "53300"
+	sqlStateFeatureNotSupported = "0A000"
+)
+
+// writeErrorMessage writes a FATAL error response with a SQLSTATE code
+func writeErrorMessage(w io.Writer, code string, message string) error {
+	payload := make([]byte, 0, 32+len(message))
+	for _, field := range []struct {
+		typ   byte
+		value string
+	}{
+		{'S', "FATAL"},
+		{'V', "FATAL"},
+		{'C', code},
+		{'M', message},
+	} {
+		payload = append(payload, field.typ)
+		payload = append(payload, field.value...)
+		payload = append(payload, 0)
+	}
+	payload = append(payload, 0)
+	return writeMessage(w, messageTypeError, payload)
+}
+
+// readCString reads a null terminated string from the front of buf and returns the remainder
+func readCString(buf []byte) (string, []byte, error) {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i]), buf[i+1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("missing string terminator")
+}
+
+// errorMessageText extracts the human readable message field from an error response payload
+func errorMessageText(payload []byte) string {
+	for len(payload) > 0 && payload[0] != 0 {
+		field := payload[0]
+		value, rest, err := readCString(payload[1:])
+		if err != nil {
+			break
+		}
+		if field == 'M' {
+			return value
+		}
+		payload = rest
+	}
+	return "unknown error"
+}
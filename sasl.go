@@ -0,0 +1,90 @@
+package pggateway
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BeginSASL starts a SASL authentication exchange with the client, offering the provided mechanisms.
+// It returns the mechanism selected by the client along with the client's initial response data.
+func (s *Session) BeginSASL(mechanisms ...string) (string, []byte, error) {
+	if len(mechanisms) == 0 {
+		return "", nil, fmt.Errorf("at least one SASL mechanism is required")
+	}
+
+	var data []byte
+	for _, m := range mechanisms {
+		data = append(data, m...)
+		data = append(data, 0)
+	}
+	data = append(data, 0)
+
+	err := writeAuthenticationMessage(s.client, authenticationMethodSASL, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload, err := s.readSASLResponse()
+	if err != nil {
+		return "", nil, err
+	}
+
+	mechanism, rest, err := readCString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed SASL initial response: %s", err)
+	}
+
+	supported := false
+	for _, m := range mechanisms {
+		if m == mechanism {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return "", nil, fmt.Errorf("client selected unsupported SASL mechanism %#v", mechanism)
+	}
+
+	if len(rest) < 4 {
+		return "", nil, fmt.Errorf("malformed SASL initial response")
+	}
+	length := int32(binary.BigEndian.Uint32(rest))
+	rest = rest[4:]
+	if length == -1 {
+		return mechanism, nil, nil
+	}
+	if length < 0 || int(length) != len(rest) {
+		return "", nil, fmt.Errorf("malformed SASL initial response")
+	}
+
+	return mechanism, rest, nil
+}
+
+// ContinueSASL sends a SASL challenge to the client and returns the client's response
+func (s *Session) ContinueSASL(data []byte) ([]byte, error) {
+	err := writeAuthenticationMessage(s.client, authenticationMethodSASLContinue, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readSASLResponse()
+}
+
+// FinishSASL sends the final SASL outcome data to the client.
+// The exchange is only complete once an AuthenticationOK is sent to the client.
+func (s *Session) FinishSASL(data []byte) error {
+	return writeAuthenticationMessage(s.client, authenticationMethodSASLFinal, data)
+}
+
+func (s *Session) readSASLResponse() ([]byte, error) {
+	typ, payload, err := readAuthMessage(s.client)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != messageTypePassword {
+		return nil, fmt.Errorf("expected SASL response message, got %#v", string(typ))
+	}
+	s.plugins.LogDebug(s.loggingContext(), "client SASL response")
+	return payload, nil
+}
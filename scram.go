@@ -0,0 +1,314 @@
+package pggateway
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	scramSHA256             = "SCRAM-SHA-256"
+	scramSHA256Plus         = "SCRAM-SHA-256-PLUS"
+	scramChannelBindingType = "tls-server-end-point"
+	scramNonceLength        = 18
+	scramSaltLength         = 16
+
+	// Same default as PostgreSQL's `scram_iterations`
+	SCRAMDefaultIterations = 4096
+)
+
+// SCRAMVerifier holds a SCRAM-SHA-256 password verifier as stored by PostgreSQL in `pg_authid.rolpassword`
+type SCRAMVerifier struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMVerifier builds a verifier for the provided password using a random salt.
+// Passwords are used as-is, SASLprep normalization is not applied.
+func NewSCRAMVerifier(password []byte, iterations int) (*SCRAMVerifier, error) {
+	if iterations <= 0 {
+		iterations = SCRAMDefaultIterations
+	}
+
+	salt := make([]byte, scramSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	saltedPassword := scramSaltedPassword(password, salt, iterations)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return &SCRAMVerifier{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, []byte("Server Key")),
+	}, nil
+}
+
+// ParseSCRAMVerifier parses a verifier in the PostgreSQL format
+// `SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>`
+func ParseSCRAMVerifier(verifier string) (*SCRAMVerifier, error) {
+	parts := strings.Split(verifier, "$")
+	if len(parts) != 3 || parts[0] != scramSHA256 {
+		return nil, fmt.Errorf("invalid SCRAM verifier")
+	}
+
+	iterSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, fmt.Errorf("invalid SCRAM verifier")
+	}
+
+	v := &SCRAMVerifier{}
+	var err error
+	v.Iterations, err = strconv.Atoi(iterSalt[0])
+	if err != nil || v.Iterations <= 0 {
+		return nil, fmt.Errorf("invalid SCRAM verifier iteration count")
+	}
+	if v.Salt, err = base64.StdEncoding.DecodeString(iterSalt[1]); err != nil {
+		return nil, fmt.Errorf("invalid SCRAM verifier salt: %s", err)
+	}
+	if v.StoredKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(v.StoredKey) != sha256.Size {
+		return nil, fmt.Errorf("invalid SCRAM verifier stored key")
+	}
+	if v.ServerKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(v.ServerKey) != sha256.Size {
+		return nil, fmt.Errorf("invalid SCRAM verifier server key")
+	}
+	return v, nil
+}
+
+func (v *SCRAMVerifier) String() string {
+	return fmt.Sprintf(
+		"%s$%d:%s$%s:%s",
+		scramSHA256,
+		v.Iterations,
+		base64.StdEncoding.EncodeToString(v.Salt),
+		base64.StdEncoding.EncodeToString(v.StoredKey),
+		base64.StdEncoding.EncodeToString(v.ServerKey),
+	)
+}
+
+// VerifySCRAM runs a SCRAM-SHA-256 exchange with the client and checks the client's proof against the verifier.
+//
+// SCRAM-SHA-256-PLUS (tls-server-end-point channel binding) is offered when the client connection uses SSL.
+// A nil verifier runs the full exchange and always fails, so unknown users cannot be told apart from bad passwords.
+// On success the server final message has been sent, the caller is still responsible for the AuthenticationOK.
+func (s *Session) VerifySCRAM(verifier *SCRAMVerifier) (bool, error) {
+	mechanisms := []string{scramSHA256}
+	if s.IsSSL && s.tlsServerEndPoint != nil {
+		mechanisms = []string{scramSHA256Plus, scramSHA256}
+	}
+
+	mechanism, clientFirst, err := s.BeginSASL(mechanisms...)
+	if err != nil {
+		return false, err
+	}
+	s.authMethod = strings.ToLower(mechanism)
+
+	gs2Header, clientFirstBare, err := splitSCRAMClientFirst(string(clientFirst))
+	if err != nil {
+		return false, err
+	}
+
+	var channelBinding []byte
+	switch {
+	case gs2Header == "p="+scramChannelBindingType+",,":
+		if mechanism != scramSHA256Plus {
+			return false, fmt.Errorf("SCRAM channel binding requested without %s", scramSHA256Plus)
+		}
+		channelBinding = s.tlsServerEndPoint
+	case strings.HasPrefix(gs2Header, "p="):
+		return false, fmt.Errorf("unsupported SCRAM channel binding type %#v", gs2Header)
+	case gs2Header == "y,,":
+		// The client supports channel binding but thinks we do not, this is a downgrade
+		if len(mechanisms) > 1 {
+			return false, fmt.Errorf("SCRAM channel binding negotiation error")
+		}
+	case gs2Header == "n,,":
+		if mechanism == scramSHA256Plus {
+			return false, fmt.Errorf("SCRAM channel binding is required for %s", scramSHA256Plus)
+		}
+	default:
+		return false, fmt.Errorf("unsupported SCRAM GS2 header %#v", gs2Header)
+	}
+
+	attrs, err := parseSCRAMAttributes(clientFirstBare)
+	if err != nil {
+		return false, err
+	}
+	clientNonce, ok := attrs["r"]
+	if !ok || clientNonce == "" {
+		return false, fmt.Errorf("SCRAM client nonce missing")
+	}
+	if _, ok := attrs["m"]; ok {
+		return false, fmt.Errorf("unsupported SCRAM extension")
+	}
+
+	mock := verifier == nil
+	if mock {
+		verifier = mockSCRAMVerifier(s.User)
+	}
+
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return false, err
+	}
+	nonce := clientNonce + serverNonce
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(verifier.Salt), verifier.Iterations)
+
+	clientFinal, err := s.ContinueSASL([]byte(serverFirst))
+	if err != nil {
+		return false, err
+	}
+
+	idx := strings.LastIndex(string(clientFinal), ",p=")
+	if idx == -1 {
+		return false, fmt.Errorf("SCRAM client proof missing")
+	}
+	clientFinalWithoutProof := string(clientFinal[:idx])
+	proof, err := base64.StdEncoding.DecodeString(string(clientFinal[idx+3:]))
+	if err != nil || len(proof) != sha256.Size {
+		return false, fmt.Errorf("malformed SCRAM client proof")
+	}
+
+	attrs, err = parseSCRAMAttributes(clientFinalWithoutProof)
+	if err != nil {
+		return false, err
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs["c"])
+	if err != nil {
+		return false, fmt.Errorf("malformed SCRAM channel binding: %s", err)
+	}
+	if !hmac.Equal(cbind, append([]byte(gs2Header), channelBinding...)) {
+		return false, fmt.Errorf("SCRAM channel binding check failed")
+	}
+	if attrs["r"] != nonce {
+		return false, fmt.Errorf("SCRAM nonce mismatch")
+	}
+
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+	clientSignature := scramHMAC(verifier.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if mock || !hmac.Equal(storedKey[:], verifier.StoredKey) {
+		return false, nil
+	}
+
+	serverSignature := scramHMAC(verifier.ServerKey, authMessage)
+	return true, s.FinishSASL([]byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)))
+}
+
+// splitSCRAMClientFirst splits a client-first-message into the GS2 header and the bare message
+func splitSCRAMClientFirst(msg string) (string, string, error) {
+	first := strings.IndexByte(msg, ',')
+	if first == -1 {
+		return "", "", fmt.Errorf("malformed SCRAM client first message")
+	}
+	second := strings.IndexByte(msg[first+1:], ',')
+	if second == -1 {
+		return "", "", fmt.Errorf("malformed SCRAM client first message")
+	}
+	second += first + 1
+
+	// PostgreSQL does not support authorization identities
+	if second != first+1 {
+		return "", "", fmt.Errorf("SCRAM authorization identity is not supported")
+	}
+	return msg[:second+1], msg[second+1:], nil
+}
+
+// parseSCRAMAttributes parses a comma separated list of `name=value` SCRAM attributes
+func parseSCRAMAttributes(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, fmt.Errorf("malformed SCRAM attribute %#v", part)
+		}
+		attrs[part[:1]] = part[2:]
+	}
+	return attrs, nil
+}
+
+// Secret used to derive stable mock salts for unknown users
+var scramMockSecret = make([]byte, sha256.Size)
+
+func init() {
+	rand.Read(scramMockSecret)
+}
+
+// mockSCRAMVerifier returns a verifier which never matches, with a salt which is stable per user
+func mockSCRAMVerifier(user []byte) *SCRAMVerifier {
+	return &SCRAMVerifier{
+		Iterations: SCRAMDefaultIterations,
+		Salt:       scramHMAC(scramMockSecret, user)[:scramSaltLength],
+		StoredKey:  make([]byte, sha256.Size),
+		ServerKey:  make([]byte, sha256.Size),
+	}
+}
+
+func scramNonce() (string, error) {
+	buf := make([]byte, scramNonceLength)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+func scramHMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramSaltedPassword computes Hi(password, salt, iterations) from RFC 5802
+func scramSaltedPassword(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// tlsServerEndPoint computes the `tls-server-end-point` channel binding data (RFC 5929) for a certificate
+func tlsServerEndPoint(cert *x509.Certificate) []byte {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		return nil
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
@@ -0,0 +1,133 @@
+package pggateway
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+type scramResult struct {
+	ok  bool
+	err error
+}
+
+// runSCRAM runs VerifySCRAM on a session against the client function on the other end of the connection.
+// With a certificate the connection uses SSL, and the session's channel binding data is `endPoint`
+func runSCRAM(t *testing.T, verifier *SCRAMVerifier, cert *tls.Certificate, endPoint []byte, client func(net.Conn) error) (*Session, scramResult, error) {
+	pipe, conn := net.Pipe()
+	server := pipe
+	if cert != nil {
+		server = tls.Server(pipe, &tls.Config{Certificates: []tls.Certificate{*cert}})
+		conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	}
+	defer conn.Close()
+
+	plugins, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := NewSession(nil, []byte("alice"), []byte("app"), cert != nil, server, nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.tlsServerEndPoint = endPoint
+
+	results := make(chan scramResult, 1)
+	go func() {
+		ok, err := sess.VerifySCRAM(verifier)
+		// Ends the client's wait for a final message the session does not send
+		pipe.Close()
+		results <- scramResult{ok, err}
+	}()
+	clientErr := client(conn)
+	return sess, <-results, clientErr
+}
+
+// scramClient logs in with loginSCRAM, as the gateway does with target servers
+func scramClient(password string) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		method, data, err := readServerAuthentication(conn)
+		if err != nil {
+			return err
+		}
+		if method != authenticationMethodSASL {
+			return fmt.Errorf("expected a SASL request, got method %d", method)
+		}
+		return loginSCRAM(conn, []byte(password), data)
+	}
+}
+
+func TestVerifySCRAM(t *testing.T) {
+	verifier, err := NewSCRAMVerifier([]byte("secret"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCA(t, "gateway")
+	cert := &tls.Certificate{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key}
+	endPoint := tlsServerEndPoint(ca.cert)
+
+	for _, test := range []struct {
+		name     string
+		verifier *SCRAMVerifier
+		password string
+		cert     *tls.Certificate
+		endPoint []byte
+		ok       bool
+		method   string
+		err      string
+	}{
+		{"valid password", verifier, "secret", nil, nil, true, "scram-sha-256", ""},
+		{"wrong password", verifier, "wrong", nil, nil, false, "scram-sha-256", ""},
+		// Unknown users go through the whole exchange and fail like a wrong password
+		{"unknown user", nil, "secret", nil, nil, false, "scram-sha-256", ""},
+		{"channel binding", verifier, "secret", cert, endPoint, true, "scram-sha-256-plus", ""},
+		{"channel binding wrong password", verifier, "wrong", cert, endPoint, false, "scram-sha-256-plus", ""},
+		// The client saw a different certificate than the one the session has, e.g. through a man in the middle
+		{"channel binding mismatch", verifier, "secret", cert, []byte("other certificate"), false, "scram-sha-256-plus", "channel binding check failed"},
+		// Without channel binding data for the session only SCRAM-SHA-256 is offered, and the client says it could have bound
+		{"channel binding not offered", verifier, "secret", cert, nil, true, "scram-sha-256", ""},
+	} {
+		sess, result, clientErr := runSCRAM(t, test.verifier, test.cert, test.endPoint, scramClient(test.password))
+		if result.ok != test.ok || sess.authMethod != test.method {
+			t.Errorf("%s: expected %v with %s, got %v with %s", test.name, test.ok, test.method, result.ok, sess.authMethod)
+		}
+		if test.err == "" && result.err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, result.err)
+		}
+		if test.err != "" && (result.err == nil || !strings.Contains(result.err.Error(), test.err)) {
+			t.Errorf("%s: expected error %#v, got %v", test.name, test.err, result.err)
+		}
+		// The client only accepts a login with the server's signature
+		if (clientErr == nil) != test.ok {
+			t.Errorf("%s: expected client login %v, got error %v", test.name, test.ok, clientErr)
+		}
+	}
+}
+
+func TestVerifySCRAMRejectsDowngrade(t *testing.T) {
+	verifier, err := NewSCRAMVerifier([]byte("secret"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCA(t, "gateway")
+	cert := &tls.Certificate{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key}
+
+	// SCRAM-SHA-256-PLUS is offered, but the client claims it was not, e.g. because the offer was tampered with
+	downgraded := func(conn net.Conn) error {
+		_, _, err := readServerAuthentication(conn)
+		if err != nil {
+			return err
+		}
+		clientFirst := "y,,n=,r=nonce"
+		initial := append([]byte(scramSHA256), 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(initial[len(scramSHA256)+1:], uint32(len(clientFirst)))
+		return writeMessage(conn, messageTypePassword, append(initial, clientFirst...))
+	}
+	_, result, _ := runSCRAM(t, verifier, cert, tlsServerEndPoint(ca.cert), downgraded)
+	if result.ok || result.err == nil || !strings.Contains(result.err.Error(), "negotiation error") {
+		t.Fatalf("expected the downgrade to be rejected, got %v with error %v", result.ok, result.err)
+	}
+}
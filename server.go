@@ -3,20 +3,31 @@ package pggateway
 import "sync"
 
 type Server struct {
-	listeners []*Listener
-	plugins   *PluginRegistry
-	config    *Config
+	listeners  []*Listener
+	plugins    *PluginRegistry
+	bruteForce *bruteForceTracker
+	config     *Config
 }
 
 func NewServer(c *Config) (*Server, error) {
-	registry, err := NewPluginRegistry(nil, c.Logging)
+	registry, err := NewPluginRegistry(nil, nil, c.Logging)
 	if err != nil {
 		return nil, err
 	}
+
+	var bruteForce *bruteForceTracker
+	if c.BruteForce != nil {
+		bruteForce, err = newBruteForceTracker(*c.BruteForce)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Server{
-		listeners: make([]*Listener, 0),
-		plugins:   registry,
-		config:    c,
+		listeners:  make([]*Listener, 0),
+		plugins:    registry,
+		bruteForce: bruteForce,
+		config:     c,
 	}, nil
 }
 
@@ -27,6 +38,8 @@ func (s *Server) Start() error {
 
 	s.listeners = s.config.GetListeners()
 	for _, l := range s.listeners {
+		// Listeners without their own configuration share the server's failed authentication tracking
+		l.bruteForce = s.bruteForce
 		err := l.Listen()
 		if err != nil {
 			s.plugins.LogError(nil, "error binding to %s: %s", l, err)
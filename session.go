@@ -1,10 +1,15 @@
 package pggateway
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/c653labs/pgproto"
 	uuid "github.com/satori/go.uuid"
@@ -17,17 +22,74 @@ type Session struct {
 
 	IsSSL    bool
 	client   net.Conn
-	target   net.Conn
 	salt     []byte
 	password []byte
 
+	// Replaced by the session's own goroutine under targetMutex, which other goroutines hold to use it
+	target      net.Conn
+	targetMutex *sync.Mutex
+
+	// `tls-server-end-point` channel binding data for the client connection
+	tlsServerEndPoint []byte
+
+	// Configured `host:port` of the target server and how to connect to it
+	targetAddr   string
+	targetDialer *targetDialer
+	// Pool the target server connection is made from once a plugin first needs it, and the member it was made to
+	targets      *targetPool
+	targetMember *targetMember
+	targetErr    error
+	// Startup message a plugin sent to the target server, sent again when the login is retried over SSL
+	targetStartup *pgproto.StartupMessage
+
 	startup *pgproto.StartupMessage
 
 	stopped bool
 
 	plugins *PluginRegistry
+
+	// Failed authentication tracking, nil when brute force protection is disabled
+	bruteForce *bruteForceTracker
+
+	credentialProvider CredentialProvider
+	closeHooks         []func()
+
+	// Name of the authentication plugin instance which authenticated the session and the method it used
+	authPlugin string
+	authMethod string
+	// Why the session was not authenticated, when decided by the gateway rather than a plugin
+	authFailure string
+	// User the session logged in to the target server as, when different from the client's user
+	targetUser []byte
+
+	sessionInit []*sessionInitRule
+
+	// Pools of backends to log in with instead of a target server connection of its own, and the session's state once it has
+	backends    *backendPools
+	targetAttrs string
+	pooled      *pooledSession
+
+	// The target server's key for the session's connection, and the key issued to the client in its place
+	backendKey backendKey
+	cancelKey  *backendKey
+}
+
+// targetConnectError is returned when no target server could be connected to, which is not a failure of the client to authenticate
+type targetConnectError struct {
+	err error
+}
+
+func (e *targetConnectError) Error() string {
+	return fmt.Sprintf("could not connect to target server: %s", e.err)
 }
 
+// errNoTarget is returned when sending to the target server from a pooled session, which only has a target server connection
+// while it runs a transaction
+var errNoTarget = fmt.Errorf("no target server connection, the authentication plugin cannot be used with connection pooling")
+
+// CredentialProvider returns the credentials LoginToServer uses for the target server in place of the ones it was given
+type CredentialProvider func(user []byte) ([]byte, []byte, error)
+
 func NewSession(startup *pgproto.StartupMessage, user []byte, database []byte, isSSL bool, client net.Conn, target net.Conn, plugins *PluginRegistry) (*Session, error) {
 	var err error
 	id, err := uuid.NewV4()
@@ -36,36 +98,88 @@ func NewSession(startup *pgproto.StartupMessage, user []byte, database []byte, i
 	}
 
 	return &Session{
-		ID:       id.String(),
-		User:     user,
-		Database: database,
-		IsSSL:    isSSL,
-		client:   client,
-		target:   target,
-		salt:     generateSalt(),
-		startup:  startup,
-		plugins:  plugins,
-		stopped:  false,
+		ID:          id.String(),
+		User:        user,
+		Database:    database,
+		IsSSL:       isSSL,
+		client:      client,
+		target:      target,
+		targetMutex: &sync.Mutex{},
+		// Replaced by the listener with the target server's, connections made to other servers do not use SSL until then
+		targetDialer: &targetDialer{mode: sslModeDisable, timeout: 10 * time.Second},
+		salt:         generateSalt(),
+		startup:      startup,
+		plugins:      plugins,
+		stopped:      false,
 	}, nil
 }
 
 func (s *Session) Close() {
-	if s.target != nil {
-		s.target.Close()
+	s.closeTarget()
+	if s.targetMember != nil {
+		s.targets.release(s.targetMember, s)
+	}
+	s.closePooled()
+	if s.cancelKey != nil {
+		cancelKeys.remove(*s.cancelKey)
+	}
+	for _, f := range s.closeHooks {
+		f()
+	}
+}
+
+// DiscardPooledConnections closes the pooled target server connections logged in as the user, e.g. before the user's
+// credentials are revoked. Connections of every database sharing the session's plugins are closed, those in use by
+// other sessions once they are returned to their pool.
+func (s *Session) DiscardPooledConnections(user []byte) {
+	for _, backends := range s.plugins.backendPools {
+		backends.discardUser(user)
 	}
 }
 
+// OnClose registers a function to call when the session ends
+func (s *Session) OnClose(f func()) {
+	s.closeHooks = append(s.closeHooks, f)
+}
+
+// SetCredentialProvider replaces the credentials used by LoginToServer, for plugins which wrap another
+// authentication plugin but log in to the target server with their own credentials
+func (s *Session) SetCredentialProvider(p CredentialProvider) {
+	s.credentialProvider = p
+}
+
 func (s *Session) String() string {
 	return fmt.Sprintf("Session<ID=%#v, User=%#v, Database=%#v>", s.ID, string(s.User), string(s.Database))
 }
 
 func (s *Session) Handle() error {
 	success, err := s.plugins.Authenticate(s, s.startup)
+	var ready []byte
+	if err == nil && success && s.pooled == nil {
+		// The target server has the final say, it authenticates passthrough clients itself
+		ready, err = s.relayLogin()
+	}
 	if err != nil {
+		if _, ok := err.(loginRejectedError); ok {
+			s.logAuthEvent(AuthResultFailure, err.Error())
+		} else {
+			s.logAuthEvent(AuthResultError, err.Error())
+		}
+		// The client is not to blame when the target server is unavailable
+		if _, ok := err.(*targetConnectError); !ok {
+			s.authenticationFailed()
+		}
 		return err
 	}
 
 	if !success {
+		if s.authFailure != "" {
+			s.logAuthEvent(AuthResultRejected, s.authFailure)
+		} else {
+			s.logAuthEvent(AuthResultFailure, "invalid credentials")
+		}
+		s.authenticationFailed()
+
 		errMsg := &pgproto.Error{
 			Severity: []byte("Fatal"),
 			Message:  []byte("failed to authenticate"),
@@ -74,9 +188,135 @@ func (s *Session) Handle() error {
 		return nil
 	}
 
+	if s.bruteForce != nil {
+		s.bruteForce.succeeded(s.User)
+	}
+	s.logAuthEvent(AuthResultSuccess, "")
+
+	if s.pooled != nil {
+		return s.proxyPooled()
+	}
+
+	err = s.initialize(ready)
+	if err != nil {
+		return err
+	}
+
 	return s.proxy()
 }
 
+// authenticationFailed counts a failed authentication attempt and delays the response to slow down guessing
+func (s *Session) authenticationFailed() {
+	if s.bruteForce == nil {
+		return
+	}
+
+	failures, delay, locked := s.bruteForce.failed(s.User, s.client.RemoteAddr())
+	if locked {
+		s.LogWarn("authentication failed, locked out after %d failures", failures)
+	} else {
+		s.LogInfo("authentication failed, %d failures, delaying response by %s", failures, delay)
+	}
+	time.Sleep(delay)
+}
+
+// TargetAddress returns the `host:port` of the target server, connecting the session to one of its target servers
+// if it is not connected yet. The configured address is returned if it cannot connect
+func (s *Session) TargetAddress() string {
+	s.connectTarget()
+	return s.targetAddr
+}
+
+// connectTarget connects the session to a target server from its pool, unless it already has a connection.
+// Sessions only connect once a plugin needs the target server, after they passed the authentication rules and lockouts.
+// The client is sent an error if none of the target servers can be connected to
+func (s *Session) connectTarget() error {
+	if s.target != nil || s.targetErr != nil {
+		return s.targetErr
+	}
+	if s.targets == nil {
+		return errNoTarget
+	}
+
+	member, target, err := s.targets.dial(s.targetAttrs)
+	if err != nil {
+		s.LogError("error connecting to target server: %s", err)
+		writeErrorMessage(s.client, sqlStateConnectionFailure, fmt.Sprintf("could not connect to target server: %s", err))
+		s.targetErr = &targetConnectError{err: err}
+		return s.targetErr
+	}
+	s.setTarget(target, member.addr)
+	s.targetMember = member
+	s.targetDialer = member.dialer
+	s.targets.attach(member, s, s.targetAttrs)
+	return nil
+}
+
+// setTarget replaces the target server connection
+func (s *Session) setTarget(target net.Conn, addr string) {
+	s.targetMutex.Lock()
+	defer s.targetMutex.Unlock()
+	if s.target != nil {
+		s.target.Close()
+	}
+	s.target = target
+	s.targetAddr = addr
+}
+
+// closeTarget closes the target server connection from another goroutine, which ends the session
+func (s *Session) closeTarget() {
+	s.targetMutex.Lock()
+	defer s.targetMutex.Unlock()
+	if s.target != nil {
+		s.target.Close()
+	}
+}
+
+// SetTargetAddress replaces the target server connection with a new connection to `host:port`,
+// it must be called before anything is sent to the target server
+func (s *Session) SetTargetAddress(addr string) error {
+	target, err := s.targetDialer.dial(addr)
+	if err != nil {
+		return err
+	}
+
+	s.setTarget(target, addr)
+	// No longer connected to the pool's member, so not affected by what happens to it
+	if s.targetMember != nil {
+		s.targets.release(s.targetMember, s)
+		s.targetMember = nil
+	}
+	return nil
+}
+
+// ClientAddress returns the address of the client connection
+func (s *Session) ClientAddress() net.Addr {
+	return s.client.RemoteAddr()
+}
+
+// TLSConnectionState returns the state of the client's SSL connection, the second value is false for non-SSL sessions
+func (s *Session) TLSConnectionState() (tls.ConnectionState, bool) {
+	conn, ok := s.client.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return conn.ConnectionState(), true
+}
+
+// ClientCertificate returns the client's verified SSL certificate, or nil if the client did not present one
+func (s *Session) ClientCertificate() *x509.Certificate {
+	conn, ok := s.client.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
 func (s *Session) GetUserPassword(method pgproto.AuthenticationMethod) (*pgproto.AuthenticationRequest, *pgproto.PasswordMessage, error) {
 	auth := &pgproto.AuthenticationRequest{
 		Method: method,
@@ -86,16 +326,21 @@ func (s *Session) GetUserPassword(method pgproto.AuthenticationMethod) (*pgproto
 	if err != nil {
 		return nil, nil, err
 	}
+	s.authMethod = "password"
+	if method == pgproto.AuthenticationMethodMD5 {
+		s.authMethod = "md5"
+	}
 
-	msg, err := s.ParseClientRequest()
+	typ, payload, err := readAuthMessage(s.client)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	pwdMsg, ok := msg.(*pgproto.PasswordMessage)
-	if !ok {
+	if typ != messageTypePassword || len(payload) == 0 || payload[len(payload)-1] != 0 {
 		return nil, nil, fmt.Errorf("expected password message")
 	}
+
+	pwdMsg := &pgproto.PasswordMessage{Password: payload[:len(payload)-1]}
+	s.plugins.LogDebug(s.loggingContextWithMessage(pwdMsg), "client request")
 	s.password = pwdMsg.Password
 
 	return auth, pwdMsg, nil
@@ -128,45 +373,80 @@ func (s *Session) parseStartupMessage() (*pgproto.StartupMessage, error) {
 	return nil, fmt.Errorf("unexpected message type")
 }
 
+// Size of the buffers used to relay framed messages
+const proxyBufferSize = 32 * 1024
+
+// proxy relays messages between the client and target server until either side ends the session,
+// parsing them only as closely as the session's plugins need
 func (s *Session) proxy() error {
-	m := &sync.Mutex{}
-	stop := sync.NewCond(m)
-	errs := make([]error, 0)
-
-	go s.proxyClientMessages(stop, errs)
-	go s.proxyServerMessages(stop, errs)
-
-	// Disable message interception
-	// go func() {
-	//	_, err := io.Copy(s.client, s.target)
-	//	errs = append(errs, err)
-	//	stop.Broadcast()
-	// }()
-
-	// go func() {
-	//	_, err := io.Copy(s.target, s.client)
-	//	errs = append(errs, err)
-	//	stop.Broadcast()
-	// }()
-
-	stop.L.Lock()
-	stop.Wait()
-	stop.L.Unlock()
+	errs := make(chan error, 2)
+
+	switch s.plugins.messageInspection() {
+	case MessageInspectionNone:
+		// Spliced by the kernel where both connections are plain TCP
+		go s.proxyRaw(s.target, s.client, errs)
+		go s.proxyRaw(s.client, s.target, errs)
+	case MessageInspectionFrames:
+		go s.proxyFrames(s.target, s.client, "client request", errs)
+		go s.proxyFrames(s.client, s.target, "server response", errs)
+	default:
+		go s.proxyClientMessages(errs)
+		go s.proxyServerMessages(errs)
+	}
+
+	err := <-errs
 	s.stopped = true
+	return err
+}
+
+func (s *Session) proxyRaw(dst io.Writer, src io.Reader, errs chan<- error) {
+	_, err := io.Copy(dst, src)
+	errs <- err
+}
+
+// proxyFrames relays messages reading only their type and length, payloads are copied through unparsed.
+// Messages are flushed whenever nothing more has been received, so none waits on the next
+func (s *Session) proxyFrames(dst io.Writer, src io.Reader, logMsg string, errs chan<- error) {
+	r := bufio.NewReaderSize(src, proxyBufferSize)
+	w := bufio.NewWriterSize(dst, proxyBufferSize)
+
+	var header [5]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			errs <- err
+			return
+		}
+		length := int64(binary.BigEndian.Uint32(header[1:]))
+		if length < 4 {
+			errs <- fmt.Errorf("invalid message length %d", length)
+			return
+		}
 
-	if len(errs) > 0 {
-		return errs[0]
+		context := s.loggingContext()
+		context["message"] = map[string]interface{}{"Type": string(header[0]), "Length": length}
+		s.plugins.LogDebug(context, logMsg)
+
+		_, err = w.Write(header[:])
+		if err == nil {
+			_, err = io.CopyN(w, r, length-4)
+		}
+		if err == nil && r.Buffered() == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			errs <- err
+			return
+		}
 	}
-	return nil
 }
 
-func (s *Session) proxyServerMessages(stop *sync.Cond, errs []error) {
+func (s *Session) proxyServerMessages(errs chan<- error) {
 	var buf []pgproto.Message
 	for !s.stopped {
 		msg, err := s.ParseServerResponse()
 		if err != nil {
-			errs = append(errs, err)
-			stop.Broadcast()
+			errs <- err
 			break
 		}
 		buf = append(buf, msg)
@@ -188,25 +468,32 @@ func (s *Session) proxyServerMessages(stop *sync.Cond, errs []error) {
 	}
 }
 
-func (s *Session) proxyClientMessages(stop *sync.Cond, errs []error) {
+func (s *Session) proxyClientMessages(errs chan<- error) {
 	for !s.stopped {
 		msg, err := s.ParseClientRequest()
 		if err != nil {
-			errs = append(errs, err)
-			stop.Broadcast()
-			break
+			errs <- err
+			return
 		}
 
 		s.WriteToServer(msg)
 
 		if _, ok := msg.(*pgproto.Termination); ok {
-			break
+			errs <- nil
+			return
 		}
 	}
 }
 
 func (s *Session) WriteToServer(msg pgproto.ClientMessage) error {
-	_, err := pgproto.WriteMessage(msg, s.target)
+	err := s.connectTarget()
+	if err != nil {
+		return err
+	}
+	if startup, ok := msg.(*pgproto.StartupMessage); ok {
+		s.targetStartup = startup
+	}
+	_, err = pgproto.WriteMessage(msg, s.target)
 	return err
 }
 
@@ -247,15 +534,38 @@ func (s *Session) ParseServerResponse() (pgproto.ServerMessage, error) {
 	return msg, err
 }
 
+func (s *Session) LogInfo(msg string, args ...interface{}) {
+	s.plugins.LogInfo(s.loggingContext(), msg, args...)
+}
+
+func (s *Session) LogWarn(msg string, args ...interface{}) {
+	s.plugins.LogWarn(s.loggingContext(), msg, args...)
+}
+
+func (s *Session) LogError(msg string, args ...interface{}) {
+	s.plugins.LogError(s.loggingContext(), msg, args...)
+}
+
+func (s *Session) LogDebug(msg string, args ...interface{}) {
+	s.plugins.LogDebug(s.loggingContext(), msg, args...)
+}
+
 func (s *Session) loggingContext() LoggingContext {
-	return LoggingContext{
+	s.targetMutex.Lock()
+	defer s.targetMutex.Unlock()
+	context := LoggingContext{
 		"session_id": s.ID,
 		"user":       string(s.User),
 		"database":   string(s.Database),
 		"ssl":        s.IsSSL,
 		"client":     s.client.RemoteAddr(),
-		"target":     s.target.RemoteAddr(),
+		"target":     s.targetAddr,
 	}
+	// Pooled sessions have no target server connection of their own
+	if s.target != nil {
+		context["target"] = s.target.RemoteAddr()
+	}
+	return context
 }
 
 func (s *Session) loggingContextWithMessage(msg pgproto.Message) LoggingContext {
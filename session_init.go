@@ -0,0 +1,224 @@
+package pggateway
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/c653labs/pgproto"
+)
+
+type sessionInitRule struct {
+	user       *regexp.Regexp
+	database   *regexp.Regexp
+	plugin     *regexp.Regexp
+	targetUser *regexp.Regexp
+
+	statements []string
+}
+
+func newSessionInitRules(configs []SessionInitConfig) ([]*sessionInitRule, error) {
+	rules := make([]*sessionInitRule, 0, len(configs))
+	for i, config := range configs {
+		rule := &sessionInitRule{}
+
+		patterns := []struct {
+			name    string
+			pattern string
+			dest    **regexp.Regexp
+		}{
+			{"user", config.User, &rule.user},
+			{"database", config.Database, &rule.database},
+			{"plugin", config.Plugin, &rule.plugin},
+			{"target_user", config.TargetUser, &rule.targetUser},
+		}
+		for _, p := range patterns {
+			if p.pattern == "" {
+				continue
+			}
+			var err error
+			*p.dest, err = GlobToRegexp(p.pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid session_init[%d] %s %#v: %s", i, p.name, p.pattern, err)
+			}
+		}
+
+		// Parameters are set with `set_config` so their values never need to be valid SQL
+		names := make([]string, 0, len(config.Parameters))
+		for name := range config.Parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rule.statements = append(rule.statements, fmt.Sprintf(
+				"SELECT pg_catalog.set_config(%s, %s, false)", quoteLiteral(name), quoteLiteral(config.Parameters[name]),
+			))
+		}
+		rule.statements = append(rule.statements, config.Statements...)
+
+		if len(rule.statements) == 0 {
+			return nil, fmt.Errorf("session_init[%d] has no parameters or statements", i)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *sessionInitRule) matches(s *Session) bool {
+	checks := []struct {
+		re    *regexp.Regexp
+		value []byte
+	}{
+		{r.user, s.User},
+		{r.database, s.Database},
+		{r.plugin, []byte(s.authPlugin)},
+		{r.targetUser, s.TargetUser()},
+	}
+	for _, c := range checks {
+		if c.re != nil && !c.re.Match(c.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// TargetUser returns the user the session logged in to the target server as
+func (s *Session) TargetUser() []byte {
+	if s.targetUser == nil {
+		return s.User
+	}
+	return s.targetUser
+}
+
+// initialize runs the statements of all matching session_init rules once the target server login completed,
+// before the client sees the login's ReadyForQuery
+func (s *Session) initialize(ready []byte) error {
+	var statements []string
+	for _, rule := range s.sessionInit {
+		if rule.matches(s) {
+			statements = append(statements, rule.statements...)
+		}
+	}
+	if len(statements) == 0 {
+		return writeMessage(s.client, messageTypeReadyForQuery, ready)
+	}
+
+	s.LogDebug("running %d session initialization statements", len(statements))
+	query := strings.Join(statements, ";\n")
+	err := writeMessage(s.target, messageTypeQuery, append([]byte(query), 0))
+	if err != nil {
+		return err
+	}
+
+	var failure string
+	for {
+		typ, payload, err := readMessage(s.target)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case messageTypeParameterStatus, messageTypeNoticeResponse:
+			// Keep the client's view of reported parameters, e.g. after `SET ROLE`, in sync
+			err = writeMessage(s.client, typ, payload)
+		case messageTypeError:
+			failure = errorMessageText(payload)
+			err = writeMessage(s.client, typ, payload)
+		case messageTypeReadyForQuery:
+			if failure != "" {
+				return fmt.Errorf("session initialization failed: %s", failure)
+			}
+			return writeMessage(s.client, typ, payload)
+		}
+		// Results of the statements are not the client's business
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// relayLogin forwards the target server's login messages to the client until the server is ready for queries,
+// relaying the client's responses to any authentication requests when the plugin let the target server authenticate the client.
+// The server's backend key is replaced with one issued by the gateway, and the ReadyForQuery payload returned.
+func (s *Session) relayLogin() ([]byte, error) {
+	relayed := false
+	for {
+		typ, payload, err := readMessage(s.target)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case messageTypeReadyForQuery:
+			return payload, nil
+		case messageTypeError:
+			// With `sslmode: allow` a non-SSL login rejected before the client took part in it is retried over SSL
+			if relayed || s.targetStartup == nil {
+				break
+			}
+			retried, err := s.retryTargetSSL()
+			if err != nil {
+				return nil, err
+			}
+			if retried {
+				_, err = pgproto.WriteMessage(s.targetStartup, s.target)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		case messageTypeBackendKeyData:
+			if key, ok := parseBackendKey(payload); ok {
+				s.backendKey = key
+				key, err = s.issueCancelKey()
+				if err != nil {
+					return nil, err
+				}
+				payload = key.payload()
+			}
+		}
+
+		err = writeMessage(s.client, typ, payload)
+		if err != nil {
+			return nil, err
+		}
+		relayed = true
+
+		switch typ {
+		case messageTypeError:
+			return nil, loginRejectedError(errorMessageText(payload))
+		case messageTypeAuthentication:
+			if len(payload) < 4 {
+				return nil, fmt.Errorf("malformed authentication request from server")
+			}
+			method := int32(binary.BigEndian.Uint32(payload))
+			if method == int32(pgproto.AuthenticationMethodOK) || method == authenticationMethodSASLFinal {
+				continue
+			}
+
+			typ, payload, err = readAuthMessage(s.client)
+			if err != nil {
+				return nil, err
+			}
+			err = writeMessage(s.target, typ, payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// loginRejectedError is returned by relayLogin when the target server rejects the login, e.g. the client's passthrough credentials
+type loginRejectedError string
+
+func (e loginRejectedError) Error() string {
+	return "server rejected login: " + string(e)
+}
+
+// quoteLiteral quotes a string as an SQL literal, independent of `standard_conforming_strings`
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `''`, -1)
+	return "E'" + s + "'"
+}
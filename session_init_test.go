@@ -0,0 +1,150 @@
+package pggateway
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/c653labs/pgproto"
+)
+
+func TestSessionInitRules(t *testing.T) {
+	rules, err := newSessionInitRules([]SessionInitConfig{
+		{
+			User:       "analyst_*",
+			Parameters: map[string]string{"search_path": "it's", "application_name": `a\b`},
+			Statements: []string{"SET ROLE analyst"},
+		},
+		{TargetUser: "reporting", Statements: []string{"SET statement_timeout = 0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Parameters in name order, quoted whatever `standard_conforming_strings` is, then the statements
+	expected := []string{
+		`SELECT pg_catalog.set_config(E'application_name', E'a\\b', false)`,
+		`SELECT pg_catalog.set_config(E'search_path', E'it''s', false)`,
+		`SET ROLE analyst`,
+	}
+	if !reflect.DeepEqual(rules[0].statements, expected) {
+		t.Errorf("expected statements %#v, got %#v", expected, rules[0].statements)
+	}
+
+	for _, test := range []struct {
+		user       string
+		targetUser string
+		rule       int
+		matches    bool
+	}{
+		{"analyst_1", "", 0, true},
+		{"analyst", "", 0, false},
+		{"analyst_1", "reporting", 1, true},
+		// Without a target server user of its own the session logged in as the client's user
+		{"reporting", "", 1, true},
+		{"analyst_1", "app", 1, false},
+	} {
+		sess := &Session{User: []byte(test.user)}
+		if test.targetUser != "" {
+			sess.targetUser = []byte(test.targetUser)
+		}
+		if rules[test.rule].matches(sess) != test.matches {
+			t.Errorf("user %#v, target user %#v: expected rule %d to match %v", test.user, test.targetUser, test.rule, test.matches)
+		}
+	}
+
+	_, err = newSessionInitRules([]SessionInitConfig{{User: "*"}})
+	if err == nil {
+		t.Error("expected a rule without parameters or statements to be rejected")
+	}
+}
+
+func TestRelayLoginAndInitialize(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugins, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := NewSession(nil, []byte("analyst_1"), []byte("app"), false, conn, target, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	sess.sessionInit, err = newSessionInitRules([]SessionInitConfig{
+		{User: "analyst_*", Parameters: map[string]string{"search_path": "analytics"}, Statements: []string{"SET ROLE analyst"}},
+		{User: "admin", Statements: []string{"SET ROLE admin"}},
+		{Statements: []string{"SET statement_timeout = 0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sess.WriteToServer(&pgproto.StartupMessage{Options: map[string][]byte{"user": []byte("analyst_1"), "database": []byte("app")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, err := sess.relayLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sess.initialize(ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The statements of every matching rule run as one query
+	expected := []string{"SELECT pg_catalog.set_config(E'search_path', E'analytics', false);\nSET ROLE analyst;\nSET statement_timeout = 0"}
+	if queries := server.log(); !reflect.DeepEqual(queries, expected) {
+		t.Errorf("expected queries %#v, got %#v", expected, queries)
+	}
+
+	// The client gets the gateway's key in place of the target server's, and none of the statements' results
+	received := ""
+	var key []byte
+	for {
+		typ, payload, err := readMessage(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += string(typ)
+		if typ == messageTypeBackendKeyData {
+			key = payload
+		}
+		if typ == messageTypeReadyForQuery {
+			break
+		}
+	}
+	if received != "RSKZ" {
+		t.Fatalf("expected the login messages and a single ReadyForQuery, got %#v", received)
+	}
+	if sess.backendKey != (backendKey{pid: 1, secret: 2}) {
+		t.Errorf("expected the target server's key to be kept, got %#v", sess.backendKey)
+	}
+	if sess.cancelKey == nil || !reflect.DeepEqual(key, sess.cancelKey.payload()) {
+		t.Fatalf("expected the client to get the issued key, got %#v", key)
+	}
+	if s, ok := cancelKeys.session(*sess.cancelKey); !ok || s != sess {
+		t.Error("expected the issued key to name the session")
+	}
+}
@@ -0,0 +1,248 @@
+package pggateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                tls.NoClientCert,
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"require":         tls.RequireAnyClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+	"verify":          tls.RequireAndVerifyClientCert,
+}
+
+// newServerTLSConfig builds the TLS configuration used to upgrade client connections, without the server certificate
+// which is loaded by newServerCertificate
+func newServerTLSConfig(config SSLConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	clientAuth, ok := clientAuthTypes[strings.ToLower(config.ClientAuth)]
+	if !ok {
+		return nil, fmt.Errorf("unknown ssl client_auth mode %#v", config.ClientAuth)
+	}
+	tlsConfig.ClientAuth = clientAuth
+
+	var cas []*x509.Certificate
+	if config.CA != "" {
+		var err error
+		cas, err = loadCertificates(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+		tlsConfig.ClientCAs = pool
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("ssl client_auth mode %#v requires a 'ca' bundle", config.ClientAuth)
+	}
+
+	if config.CRL != "" {
+		if config.CA == "" {
+			return nil, fmt.Errorf("ssl 'crl' requires a 'ca' bundle")
+		}
+		// Certificates are only checked against the CRL once verified, other modes would accept revoked certificates
+		if clientAuth != tls.VerifyClientCertIfGiven && clientAuth != tls.RequireAndVerifyClientCert {
+			return nil, fmt.Errorf("ssl 'crl' requires client_auth mode \"verify-if-given\" or \"verify\", got %#v", config.ClientAuth)
+		}
+		revoked, err := loadRevokedCertificates(config.CRL, cas)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, c := range chain {
+					if revoked[revocationKey(c.RawIssuer, c.SerialNumber)] {
+						return fmt.Errorf("certificate %#v has been revoked", c.Subject.String())
+					}
+				}
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// serverCertificate is the listener's certificate, reloaded when its files change so it can be renewed without a restart
+type serverCertificate struct {
+	certFile string
+	keyFile  string
+
+	// Guarded by mutex
+	modTime time.Time
+	cert    *tls.Certificate
+	// `tls-server-end-point` channel binding data for the certificate
+	endPoint []byte
+	mutex    *sync.Mutex
+}
+
+func newServerCertificate(config SSLConfig) (*serverCertificate, error) {
+	c := &serverCertificate{
+		certFile: config.Certificate,
+		keyFile:  config.Key,
+		mutex:    &sync.Mutex{},
+	}
+	_, _, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get returns the current certificate and its channel binding data, reloading it if either file has been modified.
+// When reloading fails the previous certificate is returned along with the error
+func (c *serverCertificate) get() (*tls.Certificate, []byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err == nil && c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, c.endPoint, nil
+	}
+	if err == nil {
+		err = c.load(modTime)
+	}
+	if err != nil && c.cert == nil {
+		return nil, nil, err
+	}
+	return c.cert, c.endPoint, err
+}
+
+func (c *serverCertificate) load(modTime time.Time) error {
+	cer, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	// Channel binding data for SCRAM-SHA-256-PLUS
+	cert, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cer
+	c.endPoint = tlsServerEndPoint(cert)
+	c.modTime = modTime
+	return nil
+}
+
+func latestModTime(filenames ...string) (time.Time, error) {
+	var latest time.Time
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %#v", filename)
+	}
+	return pool, nil
+}
+
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate in %#v: %s", filename, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %#v", filename)
+	}
+	return certs, nil
+}
+
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "\x00" + serial.String()
+}
+
+// loadRevokedCertificates loads a PEM or DER encoded certificate revocation list, keyed by revocationKey.
+// Each list must be signed by one of the CA certificates, and only revokes certificates issued by its signer
+func loadRevokedCertificates(filename string, cas []*x509.Certificate) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var ders [][]byte
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+		data = rest
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing CRL %#v: %s", filename, err)
+		}
+
+		verified := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return nil, fmt.Errorf("CRL %#v is not signed by a certificate in the 'ca' bundle", filename)
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = true
+		}
+	}
+	return revoked, nil
+}
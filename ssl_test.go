@@ -0,0 +1,180 @@
+package pggateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, serials ...int64) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestCRLRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "clients")
+	other := newTestCA(t, "other")
+	caFile := writeTestFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+
+	revokedCert := ca.issue(t, 10)
+	validCert := ca.issue(t, 11)
+	// Same serial as the revoked certificate, but from another issuer
+	otherCert := other.issue(t, 10)
+
+	config := SSLConfig{
+		CA:         caFile,
+		ClientAuth: "verify",
+		CRL:        writeTestFile(t, dir, "ca.crl", ca.crl(t, 10)),
+	}
+	tlsConfig, err := newServerTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{
+		{revokedCert, true},
+		{validCert, false},
+		{otherCert, false},
+	} {
+		err := tlsConfig.VerifyPeerCertificate(nil, [][]*x509.Certificate{{test.cert, ca.cert}})
+		if (err != nil) != test.revoked {
+			t.Errorf("certificate serial %s from %s: revoked %v, got error %v", test.cert.SerialNumber, test.cert.Issuer, test.revoked, err)
+		}
+	}
+}
+
+func TestCRLSignedByOtherCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "clients")
+	other := newTestCA(t, "other")
+	config := SSLConfig{
+		CA:         writeTestFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})),
+		ClientAuth: "verify",
+		CRL:        writeTestFile(t, dir, "other.crl", other.crl(t, 10)),
+	}
+	_, err = newServerTLSConfig(config)
+	if err == nil {
+		t.Fatal("expected a CRL not signed by the CA to be rejected")
+	}
+}
+
+func TestCRLRequiresVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pggateway-ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "clients")
+	caFile := writeTestFile(t, dir, "ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	crlFile := writeTestFile(t, dir, "ca.crl", ca.crl(t, 10))
+	for _, clientAuth := range []string{"", "none", "request", "require"} {
+		_, err = newServerTLSConfig(SSLConfig{CA: caFile, ClientAuth: clientAuth, CRL: crlFile})
+		if err == nil {
+			t.Errorf("expected a CRL with client_auth %#v to be rejected", clientAuth)
+		}
+	}
+	_, err = newServerTLSConfig(SSLConfig{CA: caFile, ClientAuth: "verify-if-given", CRL: crlFile})
+	if err != nil {
+		t.Errorf("expected a CRL with client_auth \"verify-if-given\" to be accepted, got %v", err)
+	}
+}
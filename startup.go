@@ -0,0 +1,103 @@
+package pggateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/c653labs/pgproto"
+)
+
+// Protocol code sent in place of a version by a GSSENCRequest
+const gssEncRequestCode = 80877104
+
+// The protocol version the gateway speaks, 3.0
+const (
+	protocolMajorVersion = 3
+	protocolMinorVersion = 0
+)
+
+// Prefix of startup options naming protocol extensions
+const protocolOptionPrefix = "_pq_."
+
+// Upper bound on the size of a startup packet, the same as PostgreSQL's
+const maxStartupPacketLength = 10000
+
+// readStartupPacket reads a length-prefixed startup packet without parsing it, so requests which are not
+// startup messages can be told apart
+func readStartupPacket(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[:]))
+	if length < 8 || length > maxStartupPacketLength {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+
+	packet := make([]byte, length)
+	copy(packet, header[:])
+	_, err = io.ReadFull(r, packet[4:])
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// startupCode returns the protocol version of a startup message, or the code of a request sent in its place
+func startupCode(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[4:])
+}
+
+// parseStartupPacket parses a startup message for any 3.x protocol version, telling the client with a NegotiateProtocolVersion
+// message when it asked for a newer minor version or protocol extensions. Extension options are removed so they never reach
+// the target server, which the gateway always speaks 3.0 to
+func parseStartupPacket(w io.Writer, packet []byte) (*pgproto.StartupMessage, error) {
+	code := startupCode(packet)
+	major, minor := code>>16, code&0xffff
+	if major != protocolMajorVersion {
+		message := fmt.Sprintf(
+			"unsupported frontend protocol %d.%d: server supports %d.0 to %d.%d",
+			major, minor, protocolMajorVersion, protocolMajorVersion, protocolMinorVersion,
+		)
+		writeErrorMessage(w, sqlStateFeatureNotSupported, message)
+		return nil, fmt.Errorf("%s", message)
+	}
+
+	// Parsed as a 3.0 startup message, the format is the same for every 3.x version
+	binary.BigEndian.PutUint32(packet[4:], protocolMajorVersion<<16|protocolMinorVersion)
+	startup, err := pgproto.ParseStartupMessage(bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+
+	var unsupported []string
+	for name := range startup.Options {
+		if strings.HasPrefix(name, protocolOptionPrefix) {
+			unsupported = append(unsupported, name)
+			delete(startup.Options, name)
+		}
+	}
+	if minor <= protocolMinorVersion && len(unsupported) == 0 {
+		return startup, nil
+	}
+
+	sort.Strings(unsupported)
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint32(payload, protocolMinorVersion)
+	binary.BigEndian.PutUint32(payload[4:], uint32(len(unsupported)))
+	for _, name := range unsupported {
+		payload = append(payload, name...)
+		payload = append(payload, 0)
+	}
+	err = writeMessage(w, messageTypeNegotiateProtocolVersion, payload)
+	if err != nil {
+		return nil, err
+	}
+	return startup, nil
+}
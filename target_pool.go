@@ -0,0 +1,316 @@
+package pggateway
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Strategies for choosing a target server from the pool
+const (
+	targetStrategyRoundRobin       = "round-robin"
+	targetStrategyLeastConnections = "least-connections"
+	targetStrategyWeighted         = "weighted"
+)
+
+type targetMember struct {
+	addr   string
+	dialer *targetDialer
+	weight int
+
+	// Guarded by the pool mutex
+	healthy       bool
+	role          string
+	failures      int
+	successes     int
+	active        int
+	currentWeight int
+
+	// Sessions which need the member to be the primary, terminated if it is demoted
+	primarySessions map[*Session]bool
+}
+
+func (m *targetMember) String() string {
+	return m.addr
+}
+
+type targetPool struct {
+	strategy string
+	members  []*targetMember
+	next     int
+
+	healthCheck *healthCheck
+	stop        chan struct{}
+
+	// Default `target_session_attrs` for sessions which do not ask for any
+	sessionAttrs        string
+	terminateOnDemotion bool
+
+	// Connection attempts after the first, and the backoff between them
+	retries       int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+
+	mutex   *sync.Mutex
+	plugins *PluginRegistry
+}
+
+// newTargetPool creates the pool of target servers for a listener or database, either the `targets` members
+// or the single `target`. Members without SSL options of their own use the ones from `target`.
+func newTargetPool(target TargetConfig, targets *TargetPoolConfig, plugins *PluginRegistry) (*targetPool, error) {
+	p := &targetPool{
+		strategy:     targetStrategyRoundRobin,
+		members:      make([]*targetMember, 0),
+		sessionAttrs: sessionAttrsAny,
+		retries:      target.ConnectRetries,
+		mutex:        &sync.Mutex{},
+		plugins:      plugins,
+	}
+
+	var err error
+	p.retryDelay, err = parseDurationDefault(target.ConnectRetryDelay, 250*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target connect_retry_delay %#v: %s", target.ConnectRetryDelay, err)
+	}
+	p.maxRetryDelay, err = parseDurationDefault(target.ConnectRetryMaxDelay, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target connect_retry_max_delay %#v: %s", target.ConnectRetryMaxDelay, err)
+	}
+
+	members := []TargetConfig{target}
+	if targets != nil {
+		if len(targets.Members) == 0 {
+			return nil, fmt.Errorf("'targets.members' configuration value is required")
+		}
+		members = targets.Members
+
+		switch targets.Strategy {
+		case "":
+		case targetStrategyRoundRobin, targetStrategyLeastConnections, targetStrategyWeighted:
+			p.strategy = targets.Strategy
+		default:
+			return nil, fmt.Errorf("unknown target strategy %#v", targets.Strategy)
+		}
+
+		if targets.TargetSessionAttrs != "" {
+			p.sessionAttrs = targets.TargetSessionAttrs
+			if !validSessionAttrs(p.sessionAttrs) {
+				return nil, fmt.Errorf("unknown target_session_attrs %#v", p.sessionAttrs)
+			}
+		}
+		p.terminateOnDemotion = targets.TerminateOnDemotion
+	}
+
+	for _, member := range members {
+		if member.SSLMode == "" {
+			member.SSLMode = target.SSLMode
+			member.SSLRootCert = target.SSLRootCert
+			member.SSLCert = target.SSLCert
+			member.SSLKey = target.SSLKey
+			member.SSLServerName = target.SSLServerName
+		}
+		if member.ConnectTimeout == "" {
+			member.ConnectTimeout = target.ConnectTimeout
+		}
+		dialer, err := newTargetDialer(member)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := member.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.members = append(p.members, &targetMember{
+			addr:            net.JoinHostPort(member.Host, strconv.Itoa(member.Port)),
+			dialer:          dialer,
+			weight:          weight,
+			healthy:         true,
+			primarySessions: make(map[*Session]bool),
+		})
+	}
+
+	if targets != nil && targets.HealthCheck != nil {
+		p.healthCheck, err = newHealthCheck(*targets.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+	} else if p.sessionAttrs != sessionAttrsAny || p.terminateOnDemotion {
+		return nil, fmt.Errorf("'targets.health_check' is required to detect primary and standby target servers")
+	}
+
+	return p, nil
+}
+
+// start runs the background health checks, if configured
+func (p *targetPool) start() {
+	if p.healthCheck == nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	go p.healthCheck.run(p, p.stop)
+}
+
+func (p *targetPool) close() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+// dial connects to a target server for sessions with the `target_session_attrs`, retrying with backoff while
+// none can be connected to, e.g. while the target server restarts. The member must be released once the session ends.
+func (p *targetPool) dial(attrs string) (*targetMember, net.Conn, error) {
+	delay := p.retryDelay
+	for attempt := 0; ; attempt++ {
+		member, conn, err := p.dialMembers(attrs)
+		if err == nil || attempt >= p.retries {
+			return member, conn, err
+		}
+
+		p.plugins.LogWarn(nil, "could not connect to a target server, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > p.maxRetryDelay {
+			delay = p.maxRetryDelay
+		}
+	}
+}
+
+// dialMembers connects to a target server chosen by the pool's strategy, trying the other suitable members
+// if the connection fails
+func (p *targetPool) dialMembers(attrs string) (*targetMember, net.Conn, error) {
+	tried := make(map[*targetMember]bool)
+	var lastErr error
+	for {
+		member := p.acquire(tried, attrs)
+		if member == nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			if attrs != sessionAttrsAny {
+				return nil, nil, fmt.Errorf("no healthy target servers available for target_session_attrs %#v", attrs)
+			}
+			return nil, nil, fmt.Errorf("no healthy target servers available")
+		}
+
+		conn, err := member.dialer.dial(member.addr)
+		if err == nil {
+			return member, conn, nil
+		}
+		p.release(member, nil)
+		p.plugins.LogError(nil, "error connecting to server %#v: %s", member.addr, err)
+		tried[member] = true
+		lastErr = err
+	}
+}
+
+// acquire chooses a healthy member for the session attributes which has not been tried yet, counting it as an active session
+func (p *targetPool) acquire(tried map[*targetMember]bool, attrs string) *targetMember {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	candidates := make([]*targetMember, 0, len(p.members))
+	for i := range p.members {
+		// Start at the next member in round-robin order, so ties are spread across members
+		m := p.members[(p.next+i)%len(p.members)]
+		if m.healthy && !tried[m] {
+			candidates = append(candidates, m)
+		}
+	}
+	candidates = filterByAttrs(candidates, attrs)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	chosen := candidates[0]
+	switch p.strategy {
+	case targetStrategyLeastConnections:
+		for _, m := range candidates[1:] {
+			if m.active < chosen.active {
+				chosen = m
+			}
+		}
+	case targetStrategyWeighted:
+		// Smooth weighted round-robin, spreading each member's share evenly over time
+		total := 0
+		for _, m := range candidates {
+			m.currentWeight += m.weight
+			total += m.weight
+			if m.currentWeight > chosen.currentWeight {
+				chosen = m
+			}
+		}
+		chosen.currentWeight -= total
+	}
+	p.next = (p.next + 1) % len(p.members)
+
+	chosen.active++
+	return chosen
+}
+
+// attach tracks a session using the member, so it can be terminated if it needs the primary and the member is demoted
+func (p *targetPool) attach(m *targetMember, sess *Session, attrs string) {
+	if !requiresPrimary(attrs) {
+		return
+	}
+	p.mutex.Lock()
+	m.primarySessions[sess] = true
+	p.mutex.Unlock()
+}
+
+func (p *targetPool) release(m *targetMember, sess *Session) {
+	p.mutex.Lock()
+	m.active--
+	delete(m.primarySessions, sess)
+	p.mutex.Unlock()
+}
+
+// setHealth records the result of a health check, taking the member out of or back into use once the threshold is reached
+func (p *targetPool) setHealth(m *targetMember, role string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err == nil && role != m.role {
+		p.setRole(m, role)
+	}
+
+	if err != nil {
+		m.successes = 0
+		m.failures++
+		if m.healthy && m.failures >= p.healthCheck.unhealthyThreshold {
+			m.healthy = false
+			p.plugins.LogWarn(nil, "target server %#v is unhealthy: %s", m.addr, err)
+		}
+		return
+	}
+
+	m.failures = 0
+	m.successes++
+	if !m.healthy && m.successes >= p.healthCheck.healthyThreshold {
+		m.healthy = true
+		p.plugins.LogWarn(nil, "target server %#v is healthy", m.addr)
+	}
+}
+
+func (p *targetPool) setRole(m *targetMember, role string) {
+	previous := m.role
+	m.role = role
+	if previous == targetRoleUnknown {
+		p.plugins.LogInfo(nil, "target server %#v is a %s", m.addr, role)
+		return
+	}
+	p.plugins.LogWarn(nil, "target server %#v changed from %s to %s", m.addr, previous, role)
+
+	if previous != targetRolePrimary || !p.terminateOnDemotion {
+		return
+	}
+	for sess := range m.primarySessions {
+		sess.LogWarn("terminating session, target server %#v is no longer the primary", m.addr)
+		// Closing the target connection ends the session, which then releases the member
+		sess.closeTarget()
+		delete(m.primarySessions, sess)
+	}
+}
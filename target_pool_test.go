@@ -0,0 +1,72 @@
+package pggateway
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDemotionSkipsRedirectedSessions(t *testing.T) {
+	primary := newTestBackendServer(t, 1, 8)
+	defer primary.listener.Close()
+	other := newTestBackendServer(t, 1, 8)
+	defer other.listener.Close()
+
+	plugins, err := NewPluginRegistry(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := primary.listener.Addr().(*net.TCPAddr)
+	targets, err := newTargetPool(TargetConfig{Host: "127.0.0.1", Port: addr.Port}, nil, plugins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets.terminateOnDemotion = true
+	member := targets.members[0]
+	member.role = targetRolePrimary
+
+	connect := func() *Session {
+		client, _ := net.Pipe()
+		sess, err := NewSession(nil, []byte("app"), []byte("app"), false, client, nil, plugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.targets = targets
+		sess.targetAttrs = sessionAttrsReadWrite
+		err = sess.connectTarget()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+	attached := connect()
+	defer attached.Close()
+	redirected := connect()
+	defer redirected.Close()
+
+	// A session redirected elsewhere, e.g. by a plugin, no longer depends on the member
+	err = redirected.SetTargetAddress(other.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets.mutex.Lock()
+	if member.active != 1 || len(member.primarySessions) != 1 {
+		t.Errorf("expected only the attached session on the member, got %d active and %d primary sessions", member.active, len(member.primarySessions))
+	}
+	targets.mutex.Unlock()
+
+	// Demoted while the session changes its target server connection
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		targets.setHealth(member, targetRoleStandby, nil)
+	}()
+	attached.SetTargetAddress(addr.String())
+	<-done
+
+	redirected.target.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = redirected.target.Read(make([]byte, 1))
+	if opErr, ok := err.(net.Error); !ok || !opErr.Timeout() {
+		t.Fatalf("expected the redirected session to keep its connection, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package pggateway
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/c653labs/pgproto"
+)
+
+// Roles of target servers, detected by the health check with `pg_is_in_recovery()`
+const (
+	targetRoleUnknown = ""
+	targetRolePrimary = "primary"
+	targetRoleStandby = "standby"
+)
+
+// Values for `target_session_attrs`, with the same meaning as libpq's
+const (
+	sessionAttrsAny           = "any"
+	sessionAttrsReadWrite     = "read-write"
+	sessionAttrsReadOnly      = "read-only"
+	sessionAttrsPrimary       = "primary"
+	sessionAttrsStandby       = "standby"
+	sessionAttrsPreferStandby = "prefer-standby"
+)
+
+// Startup option clients can use to choose the kind of target server, it is not sent on to the target server
+const sessionAttrsOption = "target_session_attrs"
+
+func validSessionAttrs(attrs string) bool {
+	switch attrs {
+	case sessionAttrsAny, sessionAttrsReadWrite, sessionAttrsReadOnly, sessionAttrsPrimary, sessionAttrsStandby, sessionAttrsPreferStandby:
+		return true
+	}
+	return false
+}
+
+// requiresPrimary reports whether sessions with the attributes must be on the primary
+func requiresPrimary(attrs string) bool {
+	return attrs == sessionAttrsReadWrite || attrs == sessionAttrsPrimary
+}
+
+// sessionAttrs returns the `target_session_attrs` requested by the client, either with the startup option or as
+// a suffix of the database name, e.g. `app@read-only`, or an empty string if none was. Both are removed from the
+// startup options.
+func sessionAttrs(startup *pgproto.StartupMessage) (string, error) {
+	attrs := ""
+
+	database := string(startup.Options["database"])
+	if i := strings.LastIndexByte(database, '@'); i != -1 && validSessionAttrs(database[i+1:]) {
+		attrs = database[i+1:]
+		startup.Options["database"] = []byte(database[:i])
+	}
+
+	if option, ok := startup.Options[sessionAttrsOption]; ok {
+		attrs = string(option)
+		delete(startup.Options, sessionAttrsOption)
+	}
+
+	if attrs != "" && !validSessionAttrs(attrs) {
+		return "", fmt.Errorf("invalid value for parameter %#v: %#v", sessionAttrsOption, attrs)
+	}
+	return attrs, nil
+}
+
+// filterByAttrs returns the members which can serve sessions with the attributes
+func filterByAttrs(members []*targetMember, attrs string) []*targetMember {
+	var role string
+	switch attrs {
+	case sessionAttrsReadWrite, sessionAttrsPrimary:
+		role = targetRolePrimary
+	case sessionAttrsReadOnly, sessionAttrsStandby, sessionAttrsPreferStandby:
+		role = targetRoleStandby
+	default:
+		return members
+	}
+
+	filtered := make([]*targetMember, 0, len(members))
+	for _, m := range members {
+		if m.role == role {
+			filtered = append(filtered, m)
+		}
+	}
+	if len(filtered) == 0 && attrs == sessionAttrsPreferStandby {
+		return members
+	}
+	return filtered
+}
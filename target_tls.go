@@ -0,0 +1,200 @@
+package pggateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SSL modes for the target server connection, with the same meaning as libpq's `sslmode`
+const (
+	sslModeDisable    = "disable"
+	sslModeAllow      = "allow"
+	sslModePrefer     = "prefer"
+	sslModeRequire    = "require"
+	sslModeVerifyCA   = "verify-ca"
+	sslModeVerifyFull = "verify-full"
+)
+
+// sslRequestCode is the protocol version number identifying an SSLRequest
+const sslRequestCode = 80877103
+
+type targetDialer struct {
+	mode       string
+	serverName string
+	roots      *x509.CertPool
+	certs      []tls.Certificate
+
+	// Connect timeout, zero for none
+	timeout time.Duration
+}
+
+func newTargetDialer(config TargetConfig) (*targetDialer, error) {
+	d := &targetDialer{
+		mode:       config.SSLMode,
+		serverName: config.SSLServerName,
+	}
+	switch d.mode {
+	case "":
+		d.mode = sslModeDisable
+	case sslModeDisable, sslModeAllow, sslModePrefer, sslModeRequire, sslModeVerifyCA, sslModeVerifyFull:
+	default:
+		return nil, fmt.Errorf("unknown target sslmode %#v", config.SSLMode)
+	}
+
+	var err error
+	d.timeout, err = parseDurationDefault(config.ConnectTimeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target connect_timeout %#v: %s", config.ConnectTimeout, err)
+	}
+
+	if config.SSLRootCert != "" {
+		d.roots, err = loadCertPool(config.SSLRootCert)
+		if err != nil {
+			return nil, err
+		}
+		// Like libpq, a root certificate with `require` verifies the server certificate
+		if d.mode == sslModeRequire {
+			d.mode = sslModeVerifyCA
+		}
+	}
+
+	if config.SSLCert != "" || config.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.SSLCert, config.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		d.certs = []tls.Certificate{cert}
+	}
+
+	return d, nil
+}
+
+// dial connects to the target server, negotiating SSL according to the SSL mode
+func (d *targetDialer) dial(addr string) (net.Conn, error) {
+	switch d.mode {
+	case sslModeDisable, sslModeAllow:
+		// `allow` only uses SSL after the server rejects a non-SSL login, see retrySSL
+		return d.dialTCP(addr)
+	}
+
+	conn, err := d.dialSSL(addr)
+	if err != nil && d.mode == sslModePrefer {
+		// Like libpq, `prefer` falls back to a non-SSL connection when SSL is not supported or fails
+		return d.dialTCP(addr)
+	}
+	return conn, err
+}
+
+func (d *targetDialer) dialTCP(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, d.timeout)
+}
+
+// retrySSL reports whether a rejected non-SSL login should be retried over SSL
+func (d *targetDialer) retrySSL(conn net.Conn) bool {
+	_, isSSL := conn.(*tls.Conn)
+	return d.mode == sslModeAllow && !isSSL
+}
+
+var errSSLNotSupported = fmt.Errorf("target server does not support SSL")
+
+func (d *targetDialer) dialSSL(addr string) (net.Conn, error) {
+	conn, err := d.dialTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.timeout))
+	}
+
+	// SSLRequest, the server answers with a single byte
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req, 8)
+	binary.BigEndian.PutUint32(req[4:], sslRequestCode)
+	_, err = conn.Write(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp := make([]byte, 1)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch resp[0] {
+	case 'S':
+	case 'N':
+		conn.Close()
+		return nil, errSSLNotSupported
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected response %#v to SSL request from target server", string(resp))
+	}
+
+	sslConn := tls.Client(conn, d.tlsConfig(addr))
+	err = sslConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return sslConn, nil
+}
+
+func (d *targetDialer) tlsConfig(addr string) *tls.Config {
+	serverName := d.serverName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	config := &tls.Config{
+		// Sent as SNI, Go does not send IP addresses
+		ServerName:   serverName,
+		RootCAs:      d.roots,
+		Certificates: d.certs,
+	}
+
+	switch d.mode {
+	case sslModeVerifyFull:
+	case sslModeVerifyCA:
+		// Verify the chain, but not the host name
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, d.roots)
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+	return config
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("target server sent no certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,59 @@
+package pggateway
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/c653labs/pgproto"
+)
+
+// testPassthroughPlugin lets the target server authenticate the client, like the passthrough plugin
+type testPassthroughPlugin struct{}
+
+func (p *testPassthroughPlugin) Authenticate(sess *Session, startup *pgproto.StartupMessage) (bool, error) {
+	return true, sess.WriteToServer(startup)
+}
+
+func (p *testPassthroughPlugin) MessageInspection() MessageInspection {
+	return MessageInspectionNone
+}
+
+func TestTargetSSLAllow(t *testing.T) {
+	server := newTestBackendServer(t, 1, 8)
+	defer server.listener.Close()
+	ca := newTestCA(t, "target")
+	server.mutex.Lock()
+	server.ssl = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key}}}
+	server.mutex.Unlock()
+
+	for _, test := range []struct {
+		name     string
+		plugin   AuthenticationPlugin
+		mode     string
+		received byte
+	}{
+		{"login", &testLoginPlugin{}, sslModeDisable, messageTypeError},
+		{"login", &testLoginPlugin{}, sslModeAllow, messageTypeReadyForQuery},
+		{"passthrough", &testPassthroughPlugin{}, sslModeDisable, messageTypeError},
+		{"passthrough", &testPassthroughPlugin{}, sslModeAllow, messageTypeReadyForQuery},
+	} {
+		l := newTestListener(t, server, test.plugin, nil)
+		addr := server.listener.Addr().(*net.TCPAddr)
+		targets, err := newTargetPool(TargetConfig{Host: "127.0.0.1", Port: addr.Port, SSLMode: test.mode}, nil, l.plugins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.targets = targets
+		l.databases["*"].targets = targets
+
+		received := connectTestClient(t, l)
+		if received[len(received)-1] != test.received {
+			t.Errorf("%s with sslmode %#v: expected the client to receive %#v last, got %#v", test.name, test.mode, string(test.received), received)
+		}
+		// The rejection of the non-SSL login is only relayed when it is not retried
+		if test.received == messageTypeReadyForQuery && received[0] == messageTypeError {
+			t.Errorf("%s with sslmode %#v: expected the rejected non-SSL login not to be relayed, got %#v", test.name, test.mode, received)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package pggateway
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"regexp"
+	"strings"
 )
 
 func generateSalt() []byte {
@@ -13,3 +15,13 @@ func generateSalt() []byte {
 	binary.Read(rand.Reader, binary.BigEndian, &salt[3])
 	return salt
 }
+
+// GlobToRegexp converts a pattern where `*` matches any sequence of characters to an anchored regular expression,
+// for configuration values matching names such as users, databases or ARNs
+func GlobToRegexp(pattern string) (*regexp.Regexp, error) {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+}